@@ -0,0 +1,320 @@
+package auditlog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"antrea-audit/gitops"
+
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// fingerprintSize is the maximum number of bytes at the start of a log file used to
+	// identify it across rotations.
+	fingerprintSize = 4096
+	// maxBatchLines is the maximum number of lines handed to the repository at once.
+	maxBatchLines = 500
+)
+
+type checkpoint struct {
+	Fingerprint string `json:"fingerprint"`
+	Offset      int64  `json:"offset"`
+}
+
+// Tailer follows an apiserver audit log file written with the JSON format and records its
+// events in the repository. The position reached in the file is checkpointed after every
+// batch so that a restart resumes where the previous run stopped; since events are committed
+// before the checkpoint is saved, events read again after a crash are skipped by auditID.
+type Tailer struct {
+	path           string
+	checkpointPath string
+	cr             *gitops.CustomRepo
+	file           *os.File
+	fingerprint    string
+	offset         int64
+}
+
+func NewTailer(path string, checkpointPath string, cr *gitops.CustomRepo) (*Tailer, error) {
+	t := &Tailer{
+		path:           path,
+		checkpointPath: checkpointPath,
+		cr:             cr,
+	}
+	j, err := ioutil.ReadFile(checkpointPath)
+	if os.IsNotExist(err) {
+		return t, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read audit log checkpoint: %w", err)
+	}
+	c := checkpoint{}
+	if err := json.Unmarshal(j, &c); err != nil {
+		return nil, fmt.Errorf("unable to parse audit log checkpoint: %w", err)
+	}
+	t.fingerprint = c.Fingerprint
+	t.offset = c.Offset
+	return t, nil
+}
+
+// Run polls the audit log file for new events until stopCh is closed.
+func (t *Tailer) Run(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer t.Close()
+	for {
+		if err := t.Poll(); err != nil {
+			klog.ErrorS(err, "unable to ingest audit log", "path", t.path)
+		}
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (t *Tailer) Close() {
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+}
+
+// Poll ingests the events appended to the audit log file since the last call. When the file
+// has been rotated, the remaining events of the previous file are ingested first.
+func (t *Tailer) Poll() error {
+	if t.file == nil {
+		if err := t.open(); err != nil {
+			return err
+		}
+		if t.file == nil {
+			return nil
+		}
+	}
+	rotated, err := t.isRotated()
+	if err != nil {
+		return err
+	}
+	if err := t.readAvailable(); err != nil {
+		return err
+	}
+	if !rotated {
+		return nil
+	}
+	klog.InfoS("audit log file rotated", "path", t.path)
+	t.Close()
+	t.fingerprint = ""
+	t.offset = 0
+	if err := t.saveCheckpoint(); err != nil {
+		return err
+	}
+	if err := t.open(); err != nil || t.file == nil {
+		return err
+	}
+	return t.readAvailable()
+}
+
+// open opens the audit log file, resuming from the checkpoint if it still refers to it. If the
+// file was rotated while the tailer was not running, the unread end of the rotated file is
+// ingested first, provided it can still be found next to the audit log file.
+func (t *Tailer) open() error {
+	f, err := os.Open(t.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to open audit log file: %w", err)
+	}
+	fingerprint, err := getFingerprint(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if t.fingerprint != "" && fingerprint != t.fingerprint {
+		if err := t.drainRotated(); err != nil {
+			f.Close()
+			return err
+		}
+		t.fingerprint = ""
+		t.offset = 0
+	}
+	t.file = f
+	return nil
+}
+
+func (t *Tailer) drainRotated() error {
+	base := filepath.Base(t.path)
+	prefix := strings.TrimSuffix(base, filepath.Ext(base))
+	candidates, err := filepath.Glob(filepath.Join(filepath.Dir(t.path), prefix+"*"))
+	if err != nil {
+		return fmt.Errorf("unable to list rotated audit log files: %w", err)
+	}
+	for _, candidate := range candidates {
+		if candidate == t.path {
+			continue
+		}
+		f, err := os.Open(candidate)
+		if err != nil {
+			continue
+		}
+		fingerprint, err := getFingerprint(f)
+		if err != nil || fingerprint != t.fingerprint {
+			f.Close()
+			continue
+		}
+		klog.InfoS("ingesting the end of rotated audit log file", "path", candidate)
+		t.file = f
+		err = t.readAvailable()
+		t.Close()
+		return err
+	}
+	klog.InfoS("audit log file was rotated and the previous file cannot be found, some events may not have been recorded", "path", t.path)
+	return nil
+}
+
+// isRotated returns true if the audit log path no longer refers to the open file, or if the
+// open file was truncated.
+func (t *Tailer) isRotated() (bool, error) {
+	current, err := t.file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("unable to stat audit log file: %w", err)
+	}
+	if current.Size() < t.offset {
+		klog.InfoS("audit log file truncated", "path", t.path)
+		t.fingerprint = ""
+		t.offset = 0
+		return false, nil
+	}
+	info, err := os.Stat(t.path)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, fmt.Errorf("unable to stat audit log file: %w", err)
+	}
+	return !os.SameFile(current, info), nil
+}
+
+// readAvailable ingests all the complete lines between the current offset and the end of the
+// open file.
+func (t *Tailer) readAvailable() error {
+	if t.fingerprint == "" {
+		fingerprint, err := getFingerprint(t.file)
+		if err != nil {
+			return err
+		}
+		if fingerprint == "" {
+			return nil
+		}
+		t.fingerprint = fingerprint
+	}
+	if _, err := t.file.Seek(t.offset, io.SeekStart); err != nil {
+		return fmt.Errorf("unable to seek audit log file: %w", err)
+	}
+	reader := bufio.NewReader(t.file)
+	var events []auditv1.Event
+	lines := 0
+	offset := t.offset
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// an incomplete last line is read again once the apiserver finishes writing it
+			break
+		} else if err != nil {
+			return fmt.Errorf("unable to read audit log file: %w", err)
+		}
+		offset += int64(len(line))
+		lines++
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			event := auditv1.Event{}
+			if err := json.Unmarshal(line, &event); err != nil {
+				klog.ErrorS(err, "skipping invalid audit log line", "path", t.path, "offset", offset)
+			} else if gitops.IsMutatingVerb(event.Verb) {
+				events = append(events, event)
+			}
+		}
+		if lines == maxBatchLines {
+			if err := t.commit(events, offset); err != nil {
+				return err
+			}
+			events, lines = nil, 0
+		}
+	}
+	if lines > 0 {
+		return t.commit(events, offset)
+	}
+	return nil
+}
+
+// commit records a batch of events and moves the checkpoint past them. Events which can never
+// be applied are skipped; if the other events cannot be applied, the offset is left unchanged
+// so that the next poll reads them again.
+func (t *Tailer) commit(events []auditv1.Event, offset int64) error {
+	err := t.cr.HandleEvents(events)
+	if errors.Is(err, gitops.ErrUnsupportedEvent) {
+		// the events are handled one by one to skip the ones which can never be applied,
+		// events already committed are skipped by their audit ID
+		err = t.commitEach(events)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to process audit events from log file %s: %w", t.path, err)
+	}
+	t.offset = offset
+	return t.saveCheckpoint()
+}
+
+func (t *Tailer) commitEach(events []auditv1.Event) error {
+	for _, event := range events {
+		err := t.cr.HandleEvents([]auditv1.Event{event})
+		if errors.Is(err, gitops.ErrUnsupportedEvent) {
+			klog.ErrorS(err, "skipping audit event which cannot be applied", "path", t.path, "auditID", event.AuditID)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Tailer) saveCheckpoint() error {
+	j, err := json.Marshal(checkpoint{Fingerprint: t.fingerprint, Offset: t.offset})
+	if err != nil {
+		return fmt.Errorf("unable to marshal audit log checkpoint: %w", err)
+	}
+	tmpFile := t.checkpointPath + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, j, 0600); err != nil {
+		return fmt.Errorf("unable to write audit log checkpoint: %w", err)
+	}
+	if err := os.Rename(tmpFile, t.checkpointPath); err != nil {
+		return fmt.Errorf("unable to write audit log checkpoint: %w", err)
+	}
+	return nil
+}
+
+// getFingerprint identifies a log file by the hash of its first line, or of its first
+// fingerprintSize bytes if the line is longer. It returns an empty string while the first
+// line is incomplete.
+func getFingerprint(f *os.File) (string, error) {
+	buf := make([]byte, fingerprintSize)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("unable to read audit log file: %w", err)
+	}
+	buf = buf[:n]
+	if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+		buf = buf[:i+1]
+	} else if n < fingerprintSize {
+		return "", nil
+	}
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -9,12 +9,18 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
+	"antrea-audit/gitops"
 	"antrea-audit/types"
 
 	"github.com/spf13/cobra"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
 )
 
+// cluster whose repository the commands apply to
+var cluster string
+
 // get changes flags
 var author, since, until, resource, namespace, name string
 
@@ -23,6 +29,13 @@ var tagAuthor, tagEmail string
 
 // rollback flags
 var rollbackTag, rollbackSHA string
+var rollbackDryRun bool
+
+// drift flags
+var driftCheck bool
+
+// import flags
+var importDir, importConfig string
 
 var commandName = path.Base(os.Args[0])
 
@@ -77,7 +90,7 @@ var tagCmd = &cobra.Command{
 }
 
 var rollbackCmd = &cobra.Command{
-	Use:   "rollback -t tag_name | -s commit_sha",
+	Use:   "rollback -t tag_name | -s commit_sha [--dry-run]",
 	Short: "rollback to the specified commit by tag name or SHA",
 	Args: func(cmd *cobra.Command, args []string) error {
 		if len(args) != 0 {
@@ -91,6 +104,29 @@ var rollbackCmd = &cobra.Command{
 	Run: runRollback,
 }
 
+var driftCmd = &cobra.Command{
+	Use:   "drift [--check]",
+	Short: "show differences between the cluster and the repository found by the last drift check",
+	Args:  cobra.NoArgs,
+	Run:   runDrift,
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import file... [-d dir] [-c config]",
+	Short: "build a new resource repository from archived audit logs or EventList JSON files",
+	Args:  cobra.MinimumNArgs(1),
+	Run:   runImport,
+}
+
+// serverURL returns the URL of a webhook endpoint, scoped to the selected cluster if any.
+func serverURL(endpoint string) string {
+	url := "http://localhost:" + port
+	if cluster != "" {
+		url += "/clusters/" + cluster
+	}
+	return url + endpoint
+}
+
 func getURL() string {
 	flags := []string{author, since, until, resource, namespace, name}
 	flagnames := []string{"author=", "since=", "until=", "resource=", "namespace=", "name="}
@@ -100,13 +136,13 @@ func getURL() string {
 			parts = append(parts, flagnames[i]+flag)
 		}
 	}
-	url := "http://localhost:" + port + "/changes?"
+	url := serverURL("/changes?")
 	url += strings.Join(parts, "&")
 	return url
 }
 
 func runTag(cmd *cobra.Command, args []string) {
-	url := "http://localhost:" + port + "/tag"
+	url := serverURL("/tag")
 	var request types.TagRequest
 	if args[0] == "create" {
 		request = types.TagRequest{
@@ -146,10 +182,11 @@ func runTag(cmd *cobra.Command, args []string) {
 }
 
 func runRollback(cmd *cobra.Command, args []string) {
-	url := "http://localhost:" + port + "/rollback"
+	url := serverURL("/rollback")
 	request := types.RollbackRequest{
-		Tag: rollbackTag,
-		Sha: rollbackSHA,
+		Tag:    rollbackTag,
+		Sha:    rollbackSHA,
+		DryRun: rollbackDryRun,
 	}
 	j, err := json.Marshal(request)
 	if err != nil {
@@ -171,10 +208,134 @@ func runRollback(cmd *cobra.Command, args []string) {
 		fmt.Println("Error encountered while processing rollback request")
 		return
 	}
+	if rollbackDryRun {
+		printRollbackPlan(body)
+		return
+	}
 	fmt.Println(string(body))
 }
 
+func printRollbackPlan(body []byte) {
+	plan := gitops.RollbackPlan{}
+	if err := json.Unmarshal(body, &plan); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(plan.Changes) == 0 {
+		fmt.Printf("Rollback from %s to %s would not change any resources\n", plan.Head, plan.Target)
+		return
+	}
+	fmt.Printf("Rollback from %s to %s would make the following changes:\n", plan.Head, plan.Target)
+	for _, c := range plan.Changes {
+		fmt.Printf("  %-6s %s\n", c.Action, c.Path)
+	}
+	for _, c := range plan.Changes {
+		fmt.Println()
+		fmt.Print(c.Diff)
+	}
+}
+
+func runDrift(cmd *cobra.Command, args []string) {
+	url := serverURL("/drift")
+	var resp *http.Response
+	var err error
+	if driftCheck {
+		resp, err = http.Post(url, "application/json", nil)
+	} else {
+		resp, err = http.Get(url)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		fmt.Println("Error encountered while processing drift request")
+		return
+	}
+	report := gitops.DriftReport{}
+	if err := json.Unmarshal(body, &report); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(report.Resources) == 0 {
+		fmt.Printf("No drift at %s (checked %s)\n", report.Head, report.Time.Format(time.RFC3339))
+		return
+	}
+	fmt.Printf("Drift at %s (checked %s):\n", report.Head, report.Time.Format(time.RFC3339))
+	for _, r := range report.Resources {
+		fmt.Printf("  %-8s %s\n", r.Change, r.Path)
+	}
+	if report.Commit != "" {
+		fmt.Printf("Cluster state committed as %s\n", report.Commit)
+	}
+}
+
+func runImport(cmd *cobra.Command, args []string) {
+	var events []auditv1.Event
+	for _, file := range args {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fileEvents, err := gitops.ParseEvents(data)
+		if err != nil {
+			fmt.Printf("Unable to read audit events from %s: %v\n", file, err)
+			return
+		}
+		events = append(events, fileEvents...)
+	}
+	config, err := gitops.LoadConfig(importConfig)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	registry, err := gitops.NewResourceRegistry(config.Resources)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	dir := importDir
+	var k8s *gitops.K8sClient
+	if cluster != "" {
+		var clusterConfig *gitops.ClusterConfig
+		for i := range config.Clusters {
+			if config.Clusters[i].Name == cluster {
+				clusterConfig = &config.Clusters[i]
+			}
+		}
+		if clusterConfig == nil {
+			fmt.Printf("Cluster %s is not listed in the config file\n", cluster)
+			return
+		}
+		dir = gitops.ClusterDir(importDir, cluster)
+		k8s, err = gitops.NewKubernetesFromKubeconfig(clusterConfig.Kubeconfig, clusterConfig.Context, registry)
+	} else {
+		k8s, err = gitops.NewKubernetes(registry)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	_, summary, err := gitops.ImportRepo(k8s, dir, config, events)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("Imported %d audit events (%d failed)\n", summary.Events, summary.Failed)
+	if summary.Reconciled {
+		fmt.Println("Repository reconciled with the current cluster state")
+	}
+}
+
 func init() {
+	rootCmd.PersistentFlags().StringVar(&cluster, "cluster", "", "name of the cluster when the webhook records several clusters")
 	getCmd.Flags().StringVarP(&author, "author", "a", "", "author of changes")
 	getCmd.Flags().StringVarP(&since, "since", "s", "", "start of time range")
 	getCmd.Flags().StringVarP(&until, "until", "u", "", "end of time range")
@@ -187,7 +348,13 @@ func init() {
 	rootCmd.AddCommand(tagCmd)
 	rollbackCmd.Flags().StringVarP(&rollbackTag, "tag", "t", "", "name of tag")
 	rollbackCmd.Flags().StringVarP(&rollbackSHA, "SHA", "s", "", "commit hash to rollback to")
+	rollbackCmd.Flags().BoolVar(&rollbackDryRun, "dry-run", false, "show the changes the rollback would make without applying them")
 	rootCmd.AddCommand(rollbackCmd)
+	driftCmd.Flags().BoolVar(&driftCheck, "check", false, "run a new drift check instead of showing the last result")
+	rootCmd.AddCommand(driftCmd)
+	importCmd.Flags().StringVarP(&importDir, "dir", "d", "", "directory where the resource repository is created, defaults to current working directory")
+	importCmd.Flags().StringVarP(&importConfig, "config", "c", "", "path to the audit webhook config file")
+	rootCmd.AddCommand(importCmd)
 }
 
 func main() {
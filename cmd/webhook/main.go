@@ -2,7 +2,10 @@ package main
 
 import (
 	"flag"
+	"path/filepath"
+	"time"
 
+	"antrea-audit/auditlog"
 	"antrea-audit/gitops"
 	"antrea-audit/webhook"
 
@@ -12,29 +15,115 @@ import (
 func processArgs() {
 	flag.StringVar(&portFlag, "p", "8080", "specifies port that audit webhook listens on")
 	flag.StringVar(&dirFlag, "d", "", "directory where resource repository is created, defaults to current working directory")
+	flag.StringVar(&configFlag, "c", "", "path to the audit webhook config file, defaults to tracking K8s and Antrea network policies")
+	flag.StringVar(&auditLogFlag, "f", "", "apiserver audit log file (JSON format) to ingest events from, in addition to events received by the webhook")
+	flag.StringVar(&checkpointFlag, "checkpoint", "", "file recording the position reached in the audit log file, defaults to audit-log-checkpoint.json in the repository directory")
+	flag.BoolVar(&watchFlag, "watch", false, "record changes by watching the tracked resources, for clusters where the audit webhook cannot be configured")
+	flag.DurationVar(&pollFlag, "poll-interval", 2*time.Second, "interval at which the audit log file is checked for new events")
 	flag.Parse()
 }
 
 var (
-	portFlag string
-	dirFlag  string
+	portFlag       string
+	dirFlag        string
+	configFlag     string
+	auditLogFlag   string
+	checkpointFlag string
+	watchFlag      bool
+	pollFlag       time.Duration
 )
 
 func main() {
 	klog.InitFlags(nil)
 	processArgs()
-	k8s, err := gitops.NewKubernetes()
+	config, err := gitops.LoadConfig(configFlag)
+	if err != nil {
+		klog.ErrorS(err, "unable to load audit webhook config")
+		return
+	}
+	registry, err := gitops.NewResourceRegistry(config.Resources)
+	if err != nil {
+		klog.ErrorS(err, "invalid tracked resource configuration")
+		return
+	}
+	if len(config.Clusters) > 0 {
+		runClusters(config, registry)
+		return
+	}
+	k8s, err := gitops.NewKubernetes(registry)
 	if err != nil {
 		klog.ErrorS(err, "unable to create kube client")
 		return
 	}
-	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeDisk, dirFlag)
+	cr, err := gitops.SetupRepoWithConfig(k8s, gitops.StorageModeDisk, dirFlag, config)
 	if err != nil {
 		klog.ErrorS(err, "unable to set up resource repository")
 		return
 	}
+	if err := cr.RecordOfflineChanges(); err != nil {
+		klog.ErrorS(err, "unable to record changes made while the audit webhook was not running")
+		return
+	}
+	if auditLogFlag != "" {
+		checkpoint := checkpointFlag
+		if checkpoint == "" {
+			checkpoint = filepath.Join(dirFlag, "audit-log-checkpoint.json")
+		}
+		tailer, err := auditlog.NewTailer(auditLogFlag, checkpoint, cr)
+		if err != nil {
+			klog.ErrorS(err, "unable to set up audit log ingestion")
+			return
+		}
+		go tailer.Run(pollFlag, make(chan struct{}))
+	}
+	if watchFlag && !startWatch(cr) {
+		return
+	}
 	if err := webhook.ReceiveEvents(portFlag, cr); err != nil {
 		klog.ErrorS(err, "an error occurred while running the audit webhook service")
 		return
 	}
 }
+
+// runClusters serves the clusters listed in the config, each recorded in its own repository.
+func runClusters(config *gitops.Config, registry *gitops.ResourceRegistry) {
+	if auditLogFlag != "" {
+		klog.Errorf("audit log file ingestion is not supported when the config lists clusters")
+		return
+	}
+	clusters := map[string]*gitops.CustomRepo{}
+	for _, cluster := range config.Clusters {
+		k8s, err := gitops.NewKubernetesFromKubeconfig(cluster.Kubeconfig, cluster.Context, registry)
+		if err != nil {
+			klog.ErrorS(err, "unable to create kube client", "cluster", cluster.Name)
+			return
+		}
+		cr, err := gitops.SetupClusterRepo(k8s, dirFlag, config, cluster)
+		if err != nil {
+			klog.ErrorS(err, "unable to set up resource repository", "cluster", cluster.Name)
+			return
+		}
+		if err := cr.RecordOfflineChanges(); err != nil {
+			klog.ErrorS(err, "unable to record changes made while the audit webhook was not running", "cluster", cluster.Name)
+			return
+		}
+		if watchFlag && !startWatch(cr) {
+			return
+		}
+		clusters[cluster.Name] = cr
+	}
+	if err := webhook.ReceiveClusterEvents(portFlag, clusters, ""); err != nil {
+		klog.ErrorS(err, "an error occurred while running the audit webhook service")
+		return
+	}
+}
+
+func startWatch(cr *gitops.CustomRepo) bool {
+	source, err := gitops.NewWatchSource(cr)
+	if err != nil {
+		klog.ErrorS(err, "unable to set up watch-based ingestion")
+		return false
+	}
+	go source.Run(make(chan struct{}))
+	return true
+}
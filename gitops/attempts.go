@@ -0,0 +1,133 @@
+package gitops
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/go-git/go-billy/v5/util"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+const (
+	attemptedChangesFile = "attempted-changes.jsonl"
+	defaultMaxAttempts   = 10000
+)
+
+// AttemptedChange describes a request which did not change the stored state of a tracked
+// resource: a dry-run request or a write to a subresource such as status.
+type AttemptedChange struct {
+	AuditID     string    `json:"auditID"`
+	Time        time.Time `json:"time"`
+	User        string    `json:"user"`
+	Verb        string    `json:"verb"`
+	APIGroup    string    `json:"apiGroup,omitempty"`
+	Resource    string    `json:"resource"`
+	Subresource string    `json:"subresource,omitempty"`
+	Namespace   string    `json:"namespace,omitempty"`
+	Name        string    `json:"name,omitempty"`
+	DryRun      bool      `json:"dryRun,omitempty"`
+	RequestURI  string    `json:"requestURI"`
+}
+
+// isAttempt returns true for requests which do not persist a new state of the resource.
+func isAttempt(event auditv1.Event) bool {
+	return event.ObjectRef.Subresource != "" || isDryRun(event)
+}
+
+func isDryRun(event auditv1.Event) bool {
+	uri, err := url.Parse(event.RequestURI)
+	if err != nil {
+		return false
+	}
+	return len(uri.Query()["dryRun"]) > 0
+}
+
+func newAttemptedChange(event auditv1.Event) AttemptedChange {
+	event = withObjectName(event)
+	return AttemptedChange{
+		AuditID:     string(event.AuditID),
+		Time:        getEventTime(event),
+		User:        event.User.Username,
+		Verb:        event.Verb,
+		APIGroup:    event.ObjectRef.APIGroup,
+		Resource:    event.ObjectRef.Resource,
+		Subresource: event.ObjectRef.Subresource,
+		Namespace:   event.ObjectRef.Namespace,
+		Name:        event.ObjectRef.Name,
+		DryRun:      isDryRun(event),
+		RequestURI:  event.RequestURI,
+	}
+}
+
+// recordAttempts appends attempted changes to the attempted changes record, which is kept
+// outside of the resource history. The oldest attempted changes are dropped once the record
+// holds more than the configured maximum.
+func (cr *CustomRepo) recordAttempts(events []auditv1.Event) error {
+	limit := cr.Config.Ingestion.MaxAttempts
+	if limit <= 0 {
+		limit = defaultMaxAttempts
+	}
+	contents, err := util.ReadFile(cr.stateFs, attemptedChangesFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to read attempted changes record: %w", err)
+	}
+	var lines [][]byte
+	for _, line := range bytes.Split(contents, []byte("\n")) {
+		if len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	for _, event := range events {
+		line, err := json.Marshal(newAttemptedChange(event))
+		if err != nil {
+			return fmt.Errorf("unable to marshal attempted change %s: %w", event.AuditID, err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) > limit {
+		lines = lines[len(lines)-limit:]
+	}
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if err := writeFileAtomic(cr.stateFs, attemptedChangesFile, buf.Bytes()); err != nil {
+		return fmt.Errorf("unable to write attempted changes record: %w", err)
+	}
+	return nil
+}
+
+// AttemptedChanges returns the recorded attempted changes, oldest first.
+func (cr *CustomRepo) AttemptedChanges() ([]AttemptedChange, error) {
+	cr.Mutex.Lock()
+	defer cr.Mutex.Unlock()
+	f, err := cr.stateFs.Open(attemptedChangesFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to open attempted changes record: %w", err)
+	}
+	defer f.Close()
+	var attempts []AttemptedChange
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		attempt := AttemptedChange{}
+		if err := json.Unmarshal(scanner.Bytes(), &attempt); err != nil {
+			return nil, fmt.Errorf("unable to unmarshal attempted change: %w", err)
+		}
+		attempts = append(attempts, attempt)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read attempted changes record: %w", err)
+	}
+	return attempts, nil
+}
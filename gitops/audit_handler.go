@@ -3,69 +3,273 @@ package gitops
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
 	"k8s.io/klog/v2"
 )
 
+// ErrUnsupportedEvent is wrapped by the errors of audit events which can never be applied to the
+// repository, e.g. because of their verb or a malformed response object. Retrying them is
+// pointless.
+var ErrUnsupportedEvent = errors.New("unsupported audit event")
+
+// mutatingVerbs are the verbs of the requests which change the state of a resource.
+var mutatingVerbs = map[string]bool{
+	"create":           true,
+	"update":           true,
+	"patch":            true,
+	"delete":           true,
+	"deletecollection": true,
+}
+
+// IsMutatingVerb returns true for the verbs of the audit events which may be recorded in the
+// repository.
+func IsMutatingVerb(verb string) bool {
+	return mutatingVerbs[verb]
+}
+
 func (cr *CustomRepo) HandleEventList(jsonstring []byte) error {
-	cr.Mutex.Lock()
-	defer cr.Mutex.Unlock()
+	eventList, err := unmarshalEventList(jsonstring)
+	if err != nil {
+		return err
+	}
+	return cr.HandleEvents(eventList.Items)
+}
+
+func unmarshalEventList(jsonstring []byte) (*auditv1.EventList, error) {
 	eventList := auditv1.EventList{}
 	jsonstring = bytes.TrimPrefix(jsonstring, []byte("\xef\xbb\xbf"))
-	err := json.Unmarshal(jsonstring, &eventList)
-	if err != nil {
-		return fmt.Errorf("could not unmarshal event list json: %w", err)
+	if err := json.Unmarshal(jsonstring, &eventList); err != nil {
+		return nil, fmt.Errorf("could not unmarshal event list json: %w", err)
+	}
+	return &eventList, nil
+}
+
+// HandleEvents records audit events in the repository. Events are applied in batches of
+// Ingestion.BatchSize (by default the whole list at once); each batch either produces all of
+// its commits or leaves the repository untouched. Events received while a rollback is in
+// progress are spooled to a journal and applied once the rollback has been committed.
+func (cr *CustomRepo) HandleEvents(events []auditv1.Event) error {
+	cr.Mutex.Lock()
+	defer cr.Mutex.Unlock()
+	return cr.handleEvents(events)
+}
+
+// handleEvents is HandleEvents for callers which already hold the repository mutex.
+func (cr *CustomRepo) handleEvents(events []auditv1.Event) error {
+	pending, attempts := cr.filterEvents(events)
+	if len(attempts) > 0 {
+		if err := cr.recordAttempts(attempts); err != nil {
+			return fmt.Errorf("unable to record attempted changes: %w", err)
+		}
+		for _, event := range attempts {
+			cr.auditIDs.add(string(event.AuditID))
+		}
+		if err := cr.auditIDs.save(); err != nil {
+			klog.ErrorS(err, "unable to persist processed audit IDs")
+		}
+	}
+	if cr.RollbackMode {
+		if len(pending) == 0 {
+			return nil
+		}
+		klog.InfoS("rollback in progress, spooling audit events", "count", len(pending))
+		if err := cr.journal.append(pending); err != nil {
+			return fmt.Errorf("unable to spool audit events received during rollback: %w", err)
+		}
+		return nil
+	}
+	if err := cr.replayJournal(); err != nil {
+		return fmt.Errorf("unable to replay audit events received during rollback: %w", err)
 	}
-	for _, event := range eventList.Items {
+	return cr.applyBatches(pending)
+}
+
+// filterEvents returns the events which should be recorded in the repository and, if enabled,
+// the dry-run and subresource requests which should be recorded as attempted changes.
+func (cr *CustomRepo) filterEvents(events []auditv1.Event) ([]auditv1.Event, []auditv1.Event) {
+	var pending, attempts []auditv1.Event
+	seen := map[string]bool{}
+	for _, event := range events {
+		if !IsMutatingVerb(event.Verb) {
+			klog.V(2).InfoS("audit event skipped (read-only request)", "auditID", event.AuditID, "verb", event.Verb)
+			continue
+		}
+		if _, tracked := cr.Registry.ForObjectRef(event.ObjectRef); !tracked && !cr.isCascadeDelete(event) {
+			klog.V(2).InfoS("audit event skipped (resource is not tracked)", "auditID", event.AuditID)
+			continue
+		}
 		if event.Stage != "ResponseComplete" ||
-			event.ResponseStatus.Status == "Failure" ||
+			(event.ResponseStatus != nil && event.ResponseStatus.Status == "Failure") ||
 			event.User.Username == cr.ServiceAccount {
 			klog.V(2).InfoS("audit event skipped (audit Stage != ResponseComplete, audit ResponseStatus != Success, or audit produced by rollback)")
 			continue
 		}
-		if cr.RollbackMode {
-			return fmt.Errorf("rollback in progress")
+		if !cr.eventFilter.includes(event) {
+			klog.V(2).InfoS("audit event skipped (excluded by ingestion rules)", "auditID", event.AuditID, "user", event.User.Username)
+			continue
+		}
+		auditID := string(event.AuditID)
+		if auditID != "" && (seen[auditID] || cr.auditIDs.contains(auditID)) {
+			klog.V(2).InfoS("audit event skipped (already processed)", "auditID", auditID)
+			continue
+		}
+		seen[auditID] = true
+		if isAttempt(event) {
+			klog.V(2).InfoS("audit event skipped (dry-run or subresource request)", "auditID", event.AuditID)
+			if cr.Config.Ingestion.RecordAttempts {
+				attempts = append(attempts, event)
+			}
+			continue
+		}
+		pending = append(pending, event)
+	}
+	return pending, attempts
+}
+
+func (cr *CustomRepo) applyBatches(events []auditv1.Event) error {
+	batchSize := cr.Config.Ingestion.BatchSize
+	if batchSize <= 0 {
+		batchSize = len(events)
+	}
+	for start := 0; start < len(events); start += batchSize {
+		end := start + batchSize
+		if end > len(events) {
+			end = len(events)
 		}
-		if err = cr.HandleEvent(event); err != nil {
+		if err := cr.applyEvents(events[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyEvents handles a batch of events as a single transaction: if any event fails, the
+// branch and worktree are reset to the commit the batch started from.
+func (cr *CustomRepo) applyEvents(events []auditv1.Event) error {
+	head, err := cr.Repo.Head()
+	if err != nil {
+		return fmt.Errorf("unable to get repo head: %w", err)
+	}
+	versions := cr.versions.clone()
+	for _, event := range events {
+		if err := cr.HandleEvent(event); err != nil {
+			if resetErr := cr.restoreWorktree(head.Hash()); resetErr != nil {
+				klog.ErrorS(resetErr, "unable to restore worktree after failed audit batch", "commit", head.Hash().String())
+			}
+			cr.versions = versions
 			return fmt.Errorf("could not handle event: %w", err)
 		}
 	}
+	for _, event := range events {
+		cr.auditIDs.add(string(event.AuditID))
+	}
+	if err := cr.auditIDs.save(); err != nil {
+		klog.ErrorS(err, "unable to persist processed audit IDs")
+	}
+	if err := cr.versions.save(); err != nil {
+		klog.ErrorS(err, "unable to persist resource versions")
+	}
 	return nil
 }
 
 func (cr *CustomRepo) HandleEvent(event auditv1.Event) error {
 	user := event.User.Username
 	email := event.User.Username + "+" + event.User.UID + "@audit.antrea.io"
-	message := resourceMap[event.ObjectRef.Resource+event.ObjectRef.APIGroup] + event.ObjectRef.Namespace + "/" + event.ObjectRef.Name
+	if cr.isCascadeDelete(event) {
+		return cr.handleCascadeDelete(event)
+	}
+	resource, ok := cr.Registry.ForObjectRef(event.ObjectRef)
+	if !ok {
+		return fmt.Errorf("%w: resource of audit event %s is not tracked", ErrUnsupportedEvent, event.AuditID)
+	}
+	event = withObjectName(event)
+	if event.ObjectRef.Name == "" && event.Verb != "deletecollection" {
+		return fmt.Errorf("%w: unable to determine the name of the resource of audit event %s", ErrUnsupportedEvent, event.AuditID)
+	}
+	message := resource.DisplayName + " " + event.ObjectRef.Namespace + "/" + event.ObjectRef.Name
+	version := getEventVersion(event)
+	path := cr.getRelRepoPath(event) + getFileName(event)
+	if event.Verb != "deletecollection" && cr.versions.isStale(path, version) {
+		current, _ := cr.versions.get(path)
+		klog.InfoS("stale audit event ignored, repository already holds a newer state", "auditID", event.AuditID,
+			"resource", message, "resourceVersion", version.ResourceVersion, "currentResourceVersion", current.ResourceVersion)
+		return nil
+	}
+	var obj *unstructured.Unstructured
+	reconstructed := false
+	if event.Verb == "create" || event.Verb == "update" || event.Verb == "patch" {
+		var err error
+		obj, reconstructed, err = cr.getEventObject(event, resource)
+		if apierrors.IsNotFound(err) {
+			klog.InfoS("resource of audit event without response object no longer exists, skipping", "auditID", event.AuditID, "resource", message)
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("could not get resource of audit event: %w", err)
+		}
+		if reconstructed {
+			version.ResourceVersion = obj.GetResourceVersion()
+		}
+	}
+	trailers := eventTrailers(event, version)
+	if reconstructed {
+		trailers = append(trailers, [2]string{reconstructedTrailer, "true"})
+	}
+	when := getEventTime(event)
 	switch verb := event.Verb; verb {
 	case "create":
-		if err := cr.modifyFile(event); err != nil {
+		if err := cr.modifyFile(event, obj); err != nil {
 			return fmt.Errorf("could not create new resource: %w", err)
 		}
-		if err := cr.AddAndCommit(user, email, "Created "+message); err != nil {
+		if err := cr.addAndCommitAt(user, email, withTrailers("Created "+message, trailers), when); err != nil {
 			return fmt.Errorf("could not add/commit add operation: %w", err)
 		}
 		klog.V(2).InfoS("successfully created resource", "resource", message)
-	case "patch":
-		if err := cr.modifyFile(event); err != nil {
+	case "update", "patch":
+		if err := cr.modifyFile(event, obj); err != nil {
 			return fmt.Errorf("could not update resource: %w", err)
 		}
-		if err := cr.AddAndCommit(user, email, "Updated "+message); err != nil {
-			return fmt.Errorf("could not add/commit patch operation: %w", err)
+		if err := cr.addAndCommitAt(user, email, withTrailers("Updated "+message, trailers), when); err != nil {
+			return fmt.Errorf("could not add/commit %s operation: %w", verb, err)
 		}
 		klog.V(2).InfoS("successfully updated resource", "resource", message)
 	case "delete":
-		if err := cr.deleteFile(event); err != nil {
+		if err := cr.deleteFile(event); errors.Is(err, errNotInRepository) {
+			klog.V(2).InfoS("deleted resource is not in the repository, skipping", "resource", message)
+			return nil
+		} else if err != nil {
 			return fmt.Errorf("could not delete resource: %w", err)
 		}
-		if err := cr.AddAndCommit(user, email, "Deleted "+message); err != nil {
+		if err := cr.addAndCommitAt(user, email, withTrailers("Deleted "+message, trailers), when); err != nil {
 			return fmt.Errorf("could not add/commit the delete operation: %w", err)
 		}
 		klog.V(2).InfoS("successfully deleted resource", "resource", message)
+	case "deletecollection":
+		message = strings.TrimSpace(resource.DisplayName + " collection " + event.ObjectRef.Namespace)
+		removed, err := cr.deleteCollection(event)
+		if err != nil {
+			return fmt.Errorf("could not delete resource collection: %w", err)
+		}
+		if removed == 0 {
+			klog.V(2).InfoS("no tracked resources removed by collection delete", "resource", message)
+			return nil
+		}
+		if err := cr.addAndCommitAt(user, email, withTrailers("Deleted "+message, trailers), when); err != nil {
+			return fmt.Errorf("could not add/commit the deletecollection operation: %w", err)
+		}
+		klog.V(2).InfoS("successfully deleted resource collection", "resource", message)
 	default:
-		return fmt.Errorf("must be create/patch/delete operation")
+		return fmt.Errorf("%w: must be create/update/patch/delete/deletecollection operation", ErrUnsupportedEvent)
+	}
+	if event.Verb == "delete" {
+		cr.versions.setDeleted(path, version)
+	} else if event.Verb != "deletecollection" {
+		cr.versions.set(path, version)
 	}
 	return nil
 }
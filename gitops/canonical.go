@@ -0,0 +1,136 @@
+package gitops
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// defaultedField is a field set to a default value by the apiserver (or by an admission
+// webhook) when omitted. A "[]" path element matches every item of a list.
+type defaultedField struct {
+	path  []string
+	value interface{}
+}
+
+func ruleDefaults(rules ...string) []defaultedField {
+	var fields []defaultedField
+	for _, rule := range rules {
+		fields = append(fields, defaultedField{path: []string{"spec", rule, "[]", "ports", "[]", "protocol"}, value: "TCP"})
+	}
+	return fields
+}
+
+func antreaRuleDefaults(rules ...string) []defaultedField {
+	fields := ruleDefaults(rules...)
+	for _, rule := range rules {
+		fields = append(fields,
+			defaultedField{path: []string{"spec", rule, "[]", "enableLogging"}, value: false},
+			defaultedField{path: []string{"spec", rule, "[]", "name"}, value: ""},
+		)
+	}
+	return fields
+}
+
+// defaultedFields lists, per kind, the fields removed from stored resources when they hold
+// their default value, so that a resource has the same representation whether or not the
+// default was set explicitly.
+var defaultedFields = map[schema.GroupKind][]defaultedField{
+	{Group: "networking.k8s.io", Kind: "NetworkPolicy"}:    ruleDefaults("ingress", "egress"),
+	{Group: "crd.antrea.io", Kind: "NetworkPolicy"}:        antreaRuleDefaults("ingress", "egress"),
+	{Group: "crd.antrea.io", Kind: "ClusterNetworkPolicy"}: antreaRuleDefaults("ingress", "egress"),
+}
+
+// emptyMetadataFields are removed from the object metadata when empty.
+var emptyMetadataFields = []string{"uid", "resourceVersion", "generation", "creationTimestamp", "managedFields", "selfLink", "annotations", "labels"}
+
+// marshalResource returns the canonical YAML representation of a resource stored in the
+// repository: the scrub rules are applied, server-populated fields, null values and defaulted
+// fields are removed, and keys are sorted.
+func (cr *CustomRepo) marshalResource(resource *unstructured.Unstructured) ([]byte, error) {
+	cr.scrubber.scrub(resource)
+	canonicalize(resource)
+	y, err := yaml.Marshal(resource.Object)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal resource config: %w", err)
+	}
+	return y, nil
+}
+
+func canonicalize(resource *unstructured.Unstructured) {
+	clearFields(resource)
+	if metadata, ok := resource.Object["metadata"].(map[string]interface{}); ok {
+		for _, field := range emptyMetadataFields {
+			if value, ok := metadata[field]; ok && isEmptyValue(value) {
+				delete(metadata, field)
+			}
+		}
+	}
+	for _, field := range defaultedFields[resource.GroupVersionKind().GroupKind()] {
+		removeDefault(resource.Object, field.path, field.value)
+	}
+	pruneNull(resource.Object)
+}
+
+func isEmptyValue(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+func removeDefault(obj map[string]interface{}, path []string, value interface{}) {
+	if len(path) == 0 {
+		return
+	}
+	field, ok := obj[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		if reflect.DeepEqual(field, value) {
+			delete(obj, path[0])
+		}
+		return
+	}
+	if path[1] == "[]" {
+		items, _ := field.([]interface{})
+		for _, item := range items {
+			if m, ok := item.(map[string]interface{}); ok {
+				removeDefault(m, path[2:], value)
+			}
+		}
+		return
+	}
+	if m, ok := field.(map[string]interface{}); ok {
+		removeDefault(m, path[1:], value)
+	}
+}
+
+// pruneNull removes null values from maps, which are equivalent to absent fields. Empty lists
+// and maps are kept since they can be meaningful, e.g. a NetworkPolicy with an empty list of
+// ingress rules denies all ingress traffic.
+func pruneNull(obj map[string]interface{}) {
+	for key, value := range obj {
+		switch v := value.(type) {
+		case nil:
+			delete(obj, key)
+		case []interface{}:
+			for _, item := range v {
+				if m, ok := item.(map[string]interface{}); ok {
+					pruneNull(m)
+				}
+			}
+		case map[string]interface{}:
+			pruneNull(v)
+		}
+	}
+}
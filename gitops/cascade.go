@@ -0,0 +1,102 @@
+package gitops
+
+import (
+	"fmt"
+	"strings"
+
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/klog/v2"
+)
+
+// isCascadeDelete returns true for the deletion of a namespace, or of the CRD of a tracked
+// resource: the cluster then garbage-collects tracked resources without audit events for them.
+func (cr *CustomRepo) isCascadeDelete(event auditv1.Event) bool {
+	ref := event.ObjectRef
+	if event.Verb != "delete" || ref == nil || ref.Subresource != "" || ref.Name == "" {
+		return false
+	}
+	if ref.APIGroup == "" && ref.Resource == "namespaces" {
+		return true
+	}
+	if ref.APIGroup == "apiextensions.k8s.io" && ref.Resource == "customresourcedefinitions" {
+		return len(cr.crdResources(ref.Name)) > 0
+	}
+	return false
+}
+
+// crdResources returns the tracked resources defined by the CRD with the given name, i.e.
+// <plural>.<group>.
+func (cr *CustomRepo) crdResources(name string) []TrackedResource {
+	parts := strings.SplitN(name, ".", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	var resources []TrackedResource
+	for _, resource := range cr.Registry.Resources() {
+		if resource.Resource == parts[0] && resource.Group == parts[1] {
+			resources = append(resources, resource)
+		}
+	}
+	return resources
+}
+
+// getCascadePaths returns the repo paths of the resources removed with a deleted namespace
+// or CRD. The file of a deleted namespace is included if namespaces are tracked.
+func (cr *CustomRepo) getCascadePaths(event auditv1.Event) ([]string, error) {
+	name := event.ObjectRef.Name
+	var paths []string
+	if event.ObjectRef.Resource == "namespaces" {
+		for _, resource := range cr.Registry.Resources() {
+			if !resource.Namespaced {
+				continue
+			}
+			nsPaths, err := cr.listResourceFiles(computePath("", resource.Dir, name, ""))
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, nsPaths...)
+		}
+		if resource, ok := cr.Registry.ForObjectRef(event.ObjectRef); ok {
+			paths = append(paths, computePath("", resource.Dir, "", name+".yaml"))
+		}
+		return paths, nil
+	}
+	for _, resource := range cr.crdResources(name) {
+		resourcePaths, err := cr.listResourceFiles(resource.Dir)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, resourcePaths...)
+	}
+	return paths, nil
+}
+
+// handleCascadeDelete removes the resources deleted with a namespace or CRD in a commit
+// attributed to the user who deleted it.
+func (cr *CustomRepo) handleCascadeDelete(event auditv1.Event) error {
+	user := event.User.Username
+	email := event.User.Username + "+" + event.User.UID + "@audit.antrea.io"
+	message := "namespace " + event.ObjectRef.Name
+	if event.ObjectRef.Resource == "customresourcedefinitions" {
+		message = "custom resource definition " + event.ObjectRef.Name
+	}
+	paths, err := cr.getCascadePaths(event)
+	if err != nil {
+		return fmt.Errorf("could not list resources deleted with %s: %w", message, err)
+	}
+	version := getEventVersion(event)
+	removed, err := cr.removePaths(paths, version)
+	if err != nil {
+		return fmt.Errorf("could not delete resources deleted with %s: %w", message, err)
+	}
+	if removed == 0 {
+		klog.V(2).InfoS("no tracked resources removed with deleted object", "object", message)
+		return nil
+	}
+	trailers := eventTrailers(event, version)
+	if err := cr.addAndCommitAt(user, email, withTrailers("Deleted "+message, trailers), getEventTime(event)); err != nil {
+		return fmt.Errorf("could not add/commit the delete operation: %w", err)
+	}
+	klog.V(2).InfoS("successfully deleted resources of deleted object", "object", message, "count", removed)
+	return nil
+}
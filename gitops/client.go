@@ -2,6 +2,7 @@ package gitops
 
 import (
 	"context"
+	goerrors "errors"
 	"fmt"
 	"os"
 
@@ -9,8 +10,10 @@ import (
 	"k8s.io/klog/v2"
 
 	"antrea.io/antrea/pkg/apis/crd/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
 	networking "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -23,7 +26,9 @@ type K8sClient struct {
 	client.Client
 }
 
-func NewKubernetes() (*K8sClient, error) {
+// NewKubernetes creates a client for the cluster the process runs in, or for the cluster of the
+// KUBECONFIG file, which knows the types of the resources tracked by the registry.
+func NewKubernetes(registry *ResourceRegistry) (*K8sClient, error) {
 	config, err := rest.InClusterConfig()
 	if err != nil {
 		kubeconfig, hasIt := os.LookupEnv("KUBECONFIG")
@@ -35,66 +40,74 @@ func NewKubernetes() (*K8sClient, error) {
 			return nil, fmt.Errorf("unable to build config from flags, check KUBECONFIG file: %w", err)
 		}
 	}
+	return newKubernetesForConfig(config, registry)
+}
+
+// NewKubernetesFromKubeconfig creates a client for the cluster of the given kubeconfig file
+// context, or of its current context if none is given.
+func NewKubernetesFromKubeconfig(kubeconfig string, context string, registry *ResourceRegistry) (*K8sClient, error) {
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfig},
+		&clientcmd.ConfigOverrides{CurrentContext: context},
+	).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load kubeconfig %s: %w", kubeconfig, err)
+	}
+	return newKubernetesForConfig(config, registry)
+}
+
+func newKubernetesForConfig(config *rest.Config, registry *ResourceRegistry) (*K8sClient, error) {
 	scheme := runtime.NewScheme()
-	RegisterTypes(scheme)
-	client, err := client.New(config, client.Options{Scheme: scheme})
+	registry.RegisterTypes(scheme)
+	client, err := client.NewWithWatch(config, client.Options{Scheme: scheme})
 	if err != nil {
 		return nil, fmt.Errorf("unable to instantiate new generic client: %w", err)
 	}
 	return &K8sClient{client}, nil
 }
 
+// typedObjects holds the Go types of the tracked kinds known to this package. Tracked kinds
+// without an entry are registered as unstructured objects.
+var typedObjects = map[schema.GroupVersionKind]runtime.Object{
+	{Group: "networking.k8s.io", Version: "v1", Kind: "NetworkPolicy"}:              &networking.NetworkPolicy{},
+	{Group: "networking.k8s.io", Version: "v1", Kind: "NetworkPolicyList"}:          &networking.NetworkPolicyList{},
+	{Group: "crd.antrea.io", Version: "v1alpha1", Kind: "NetworkPolicy"}:            &v1alpha1.NetworkPolicy{},
+	{Group: "crd.antrea.io", Version: "v1alpha1", Kind: "NetworkPolicyList"}:        &v1alpha1.NetworkPolicyList{},
+	{Group: "crd.antrea.io", Version: "v1alpha1", Kind: "ClusterNetworkPolicy"}:     &v1alpha1.ClusterNetworkPolicy{},
+	{Group: "crd.antrea.io", Version: "v1alpha1", Kind: "ClusterNetworkPolicyList"}: &v1alpha1.ClusterNetworkPolicyList{},
+	{Group: "crd.antrea.io", Version: "v1alpha1", Kind: "Tier"}:                     &v1alpha1.Tier{},
+	{Group: "crd.antrea.io", Version: "v1alpha1", Kind: "TierList"}:                 &v1alpha1.TierList{},
+	{Group: "", Version: "v1", Kind: "Namespace"}:                                   &corev1.Namespace{},
+	{Group: "", Version: "v1", Kind: "NamespaceList"}:                               &corev1.NamespaceList{},
+}
+
 func RegisterTypes(scheme *runtime.Scheme) {
-	scheme.AddKnownTypeWithName(schema.GroupVersionKind{
-		Group:   "networking.k8s.io",
-		Version: "v1",
-		Kind:    "NetworkPolicy"},
-		&networking.NetworkPolicy{})
-	scheme.AddKnownTypeWithName(schema.GroupVersionKind{
-		Group:   "networking.k8s.io",
-		Version: "v1",
-		Kind:    "NetworkPolicyList"},
-		&networking.NetworkPolicyList{})
-	scheme.AddKnownTypeWithName(schema.GroupVersionKind{
-		Group:   "networking.k8s.io",
-		Version: "v1",
-		Kind:    "ListOptions"},
-		&metav1.ListOptions{})
-	scheme.AddKnownTypeWithName(schema.GroupVersionKind{
-		Group:   "crd.antrea.io",
-		Version: "v1alpha1",
-		Kind:    "NetworkPolicy"},
-		&v1alpha1.NetworkPolicy{})
-	scheme.AddKnownTypeWithName(schema.GroupVersionKind{
-		Group:   "crd.antrea.io",
-		Version: "v1alpha1",
-		Kind:    "NetworkPolicyList"},
-		&v1alpha1.NetworkPolicyList{})
-	scheme.AddKnownTypeWithName(schema.GroupVersionKind{
-		Group:   "crd.antrea.io",
-		Version: "v1alpha1",
-		Kind:    "ClusterNetworkPolicy"},
-		&v1alpha1.ClusterNetworkPolicy{})
-	scheme.AddKnownTypeWithName(schema.GroupVersionKind{
-		Group:   "crd.antrea.io",
-		Version: "v1alpha1",
-		Kind:    "ClusterNetworkPolicyList"},
-		&v1alpha1.ClusterNetworkPolicyList{})
-	scheme.AddKnownTypeWithName(schema.GroupVersionKind{
-		Group:   "crd.antrea.io",
-		Version: "v1alpha1",
-		Kind:    "Tier"},
-		&v1alpha1.Tier{})
-	scheme.AddKnownTypeWithName(schema.GroupVersionKind{
-		Group:   "crd.antrea.io",
-		Version: "v1alpha1",
-		Kind:    "TierList"},
-		&v1alpha1.TierList{})
-	scheme.AddKnownTypeWithName(schema.GroupVersionKind{
-		Group:   "crd.antrea.io",
-		Version: "v1alpha1",
-		Kind:    "ListOptions"},
-		&metav1.ListOptions{})
+	DefaultResourceRegistry().RegisterTypes(scheme)
+}
+
+// RegisterTypes adds the tracked kinds and their lists to the scheme, and the list options of
+// each of their group versions.
+func (r *ResourceRegistry) RegisterTypes(scheme *runtime.Scheme) {
+	groupVersions := map[schema.GroupVersion]bool{}
+	for _, resource := range r.resources {
+		for _, gvk := range resource.GroupVersionKinds() {
+			listGVK := gvk.GroupVersion().WithKind(gvk.Kind + "List")
+			if obj, ok := typedObjects[gvk]; ok {
+				scheme.AddKnownTypeWithName(gvk, obj.DeepCopyObject())
+			} else {
+				scheme.AddKnownTypeWithName(gvk, &unstructured.Unstructured{})
+			}
+			if obj, ok := typedObjects[listGVK]; ok {
+				scheme.AddKnownTypeWithName(listGVK, obj.DeepCopyObject())
+			} else {
+				scheme.AddKnownTypeWithName(listGVK, &unstructured.UnstructuredList{})
+			}
+			groupVersions[gvk.GroupVersion()] = true
+		}
+	}
+	for gv := range groupVersions {
+		scheme.AddKnownTypeWithName(gv.WithKind("ListOptions"), &metav1.ListOptions{})
+	}
 }
 
 func (k *K8sClient) GetResource(resource *unstructured.Unstructured, namespace string, name string) (*unstructured.Unstructured, error) {
@@ -147,3 +160,14 @@ func (k *K8sClient) DeleteResource(resource *unstructured.Unstructured) error {
 	klog.V(2).InfoS("deleted k8s network policy", "resourceName", resource.GetName())
 	return nil
 }
+
+// isResourceNotServed returns true if the error indicates that the cluster does not serve the
+// requested resource type, e.g. because an optional CRD is not installed.
+func isResourceNotServed(err error) bool {
+	if err == nil {
+		return false
+	}
+	var noKindMatch *meta.NoKindMatchError
+	var noResourceMatch *meta.NoResourceMatchError
+	return goerrors.As(err, &noKindMatch) || goerrors.As(err, &noResourceMatch) || errors.IsNotFound(err)
+}
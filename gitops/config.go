@@ -0,0 +1,112 @@
+package gitops
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Config is the audit webhook configuration, loaded from a YAML file.
+type Config struct {
+	// Resources lists the resource kinds tracked in the repository. The built-in set of
+	// K8s and Antrea network policy kinds is used when empty.
+	Resources []TrackedResource `json:"resources,omitempty"`
+	Ingestion IngestionConfig   `json:"ingestion,omitempty"`
+	// Scrub lists the rules applied to the annotations and labels of stored resources, in
+	// addition to the server-populated fields which are always removed.
+	Scrub []ScrubRule `json:"scrub,omitempty"`
+	Drift DriftConfig `json:"drift,omitempty"`
+	// Clusters lists the clusters whose resources are recorded. Each cluster has its own
+	// repository under clusters/<name> rather than a subtree or branch of a shared one, so that
+	// the history, tags, rollbacks and state files of a cluster do not depend on the others.
+	// When empty, the webhook records the cluster it runs in.
+	Clusters []ClusterConfig `json:"clusters,omitempty"`
+}
+
+type ClusterConfig struct {
+	// Name identifies the cluster in webhook URLs (/clusters/<name>/...) and in the storage
+	// directory (clusters/<name>).
+	Name string `json:"name"`
+	// Kubeconfig is the path to the kubeconfig file used to read from and roll back the
+	// cluster, and Context the kubeconfig context to use instead of the current one.
+	Kubeconfig string `json:"kubeconfig"`
+	Context    string `json:"context,omitempty"`
+	// Username is the user the kubeconfig authenticates as. Changes made by this user, i.e.
+	// rollbacks, are not recorded. It is required when Kubeconfig is set, since the
+	// webhook's service account is not the one making the changes then.
+	Username string `json:"username,omitempty"`
+}
+
+// ClusterDir returns the directory holding the repository of a cluster.
+func ClusterDir(dir string, name string) string {
+	return filepath.Join(dir, "clusters", name)
+}
+
+type IngestionConfig struct {
+	// BatchSize is the number of audit events of a list applied to the repository as one
+	// transaction. The whole list is applied at once when unset.
+	BatchSize int `json:"batchSize,omitempty"`
+	// QueueSize is the maximum number of audit event lists received by the webhook and
+	// waiting to be applied to the repository. Defaults to 1000.
+	QueueSize int `json:"queueSize,omitempty"`
+	// RecordAttempts enables recording dry-run requests and writes to subresources, which are
+	// never committed, in a separate attempted changes record.
+	RecordAttempts bool `json:"recordAttempts,omitempty"`
+	// MaxAttempts is the number of attempted changes kept in the record, the oldest ones
+	// being dropped. Defaults to 10000.
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+	// Rules decide which audit events are recorded; the first matching rule applies and
+	// events matching no rule are recorded. Changes made by the webhook's own service
+	// account are never recorded.
+	Rules []EventRule `json:"rules,omitempty"`
+}
+
+type DriftConfig struct {
+	// Interval is the time between two comparisons of the cluster with the repository.
+	// Defaults to 10m; periodic checks are disabled when negative.
+	Interval metav1.Duration `json:"interval,omitempty"`
+	// Mode is Report (the default) to only report drift, or Commit to also commit the
+	// cluster state to the repository.
+	Mode DriftMode `json:"mode,omitempty"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Resources: defaultTrackedResources,
+	}
+}
+
+func LoadConfig(path string) (*Config, error) {
+	if path == "" {
+		return DefaultConfig(), nil
+	}
+	y, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file %s: %w", path, err)
+	}
+	config := &Config{}
+	if err := yaml.Unmarshal(y, config); err != nil {
+		return nil, fmt.Errorf("unable to parse config file %s: %w", path, err)
+	}
+	if len(config.Resources) == 0 {
+		config.Resources = defaultTrackedResources
+	}
+	names := map[string]bool{}
+	for _, cluster := range config.Clusters {
+		if cluster.Name == "" || strings.ContainsAny(cluster.Name, "/\\") || cluster.Name == "." || cluster.Name == ".." {
+			return nil, fmt.Errorf("invalid cluster name %q in config file %s", cluster.Name, path)
+		}
+		if names[cluster.Name] {
+			return nil, fmt.Errorf("duplicate cluster %s in config file %s", cluster.Name, path)
+		}
+		if cluster.Kubeconfig != "" && cluster.Username == "" {
+			return nil, fmt.Errorf("cluster %s in config file %s must set the username of its kubeconfig", cluster.Name, path)
+		}
+		names[cluster.Name] = true
+	}
+	return config, nil
+}
@@ -0,0 +1,155 @@
+package gitops
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	billy "github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"k8s.io/klog/v2"
+)
+
+const (
+	auditIndexFile        = "processed-audit-ids"
+	defaultAuditIndexSize = 10000
+	auditIDTrailer        = "Audit-ID"
+)
+
+// auditIndex is a bounded record of the IDs of audit events already committed to the
+// repository. It is persisted so that batches retried by the apiserver after a restart of
+// the webhook are not committed twice.
+type auditIndex struct {
+	fs    billy.Filesystem
+	limit int
+	ids   map[string]bool
+	order []string
+}
+
+func newAuditIndex(fs billy.Filesystem, limit int) *auditIndex {
+	return &auditIndex{
+		fs:    fs,
+		limit: limit,
+		ids:   map[string]bool{},
+	}
+}
+
+func (idx *auditIndex) contains(id string) bool {
+	return idx.ids[id]
+}
+
+// add records an ID, evicting the oldest IDs once the index is full.
+func (idx *auditIndex) add(id string) {
+	if id == "" || idx.ids[id] {
+		return
+	}
+	idx.ids[id] = true
+	idx.order = append(idx.order, id)
+	for len(idx.order) > idx.limit {
+		delete(idx.ids, idx.order[0])
+		idx.order = idx.order[1:]
+	}
+}
+
+func (idx *auditIndex) load() (bool, error) {
+	f, err := idx.fs.Open(auditIndexFile)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("unable to open audit index: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		idx.add(strings.TrimSpace(scanner.Text()))
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("unable to read audit index: %w", err)
+	}
+	return true, nil
+}
+
+func (idx *auditIndex) save() error {
+	tmpFile := auditIndexFile + ".tmp"
+	f, err := idx.fs.Create(tmpFile)
+	if err != nil {
+		return fmt.Errorf("unable to create audit index: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	for _, id := range idx.order {
+		w.WriteString(id + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write audit index: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unable to write audit index: %w", err)
+	}
+	if err := idx.fs.Rename(tmpFile, auditIndexFile); err != nil {
+		return fmt.Errorf("unable to replace audit index: %w", err)
+	}
+	return nil
+}
+
+// loadAuditIndex restores the processed audit IDs from disk, or from the Audit-ID trailers
+// of the most recent commits if the index file is missing.
+func (cr *CustomRepo) loadAuditIndex() error {
+	found, err := cr.auditIDs.load()
+	if err != nil || found {
+		return err
+	}
+	head, err := cr.Repo.Head()
+	if err != nil {
+		return fmt.Errorf("unable to get repo head: %w", err)
+	}
+	cIter, err := cr.Repo.Log(&git.LogOptions{From: head.Hash()})
+	if err != nil {
+		return fmt.Errorf("unable to get logs from repository: %w", err)
+	}
+	var ids []string
+	err = cIter.ForEach(func(c *object.Commit) error {
+		if id := getTrailer(c.Message, auditIDTrailer); id != "" {
+			ids = append(ids, id)
+		}
+		if len(ids) >= cr.auditIDs.limit {
+			return storer.ErrStop
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to read audit IDs from commits: %w", err)
+	}
+	for i := len(ids) - 1; i >= 0; i-- {
+		cr.auditIDs.add(ids[i])
+	}
+	klog.V(2).InfoS("rebuilt processed audit IDs from commit history", "count", len(ids))
+	return cr.auditIDs.save()
+}
+
+// withTrailers appends git trailers to a commit message, skipping empty values.
+func withTrailers(message string, trailers [][2]string) string {
+	var lines []string
+	for _, trailer := range trailers {
+		if trailer[1] != "" {
+			lines = append(lines, trailer[0]+": "+trailer[1])
+		}
+	}
+	if len(lines) == 0 {
+		return message
+	}
+	return message + "\n\n" + strings.Join(lines, "\n") + "\n"
+}
+
+// getTrailer returns the value of the given trailer in a commit message.
+func getTrailer(message string, key string) string {
+	for _, line := range strings.Split(message, "\n") {
+		if strings.HasPrefix(line, key+": ") {
+			return strings.TrimPrefix(line, key+": ")
+		}
+	}
+	return ""
+}
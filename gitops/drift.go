@@ -0,0 +1,217 @@
+package gitops
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/klog/v2"
+)
+
+type DriftMode string
+
+const (
+	// DriftModeReport only reports differences between the cluster and the repository.
+	DriftModeReport DriftMode = "Report"
+	// DriftModeCommit also commits the cluster state to the repository.
+	DriftModeCommit DriftMode = "Commit"
+
+	defaultDriftInterval = 10 * time.Minute
+	driftCommitMessage   = "Drift: update repository to match cluster state"
+)
+
+type DriftChange string
+
+const (
+	// DriftAdded means the resource exists in the cluster but not in the repository.
+	DriftAdded DriftChange = "Added"
+	// DriftModified means the resource differs between the cluster and the repository.
+	DriftModified DriftChange = "Modified"
+	// DriftRemoved means the resource exists in the repository but not in the cluster.
+	DriftRemoved DriftChange = "Removed"
+)
+
+type DriftedResource struct {
+	Path   string      `json:"path"`
+	Change DriftChange `json:"change"`
+}
+
+// DriftReport is the result of comparing the tracked resources in the cluster with the files
+// at the repository HEAD.
+type DriftReport struct {
+	Time      time.Time         `json:"time"`
+	Head      string            `json:"head"`
+	Resources []DriftedResource `json:"resources"`
+	// Commit is the drift commit recording the cluster state, if one was created.
+	Commit string `json:"commit,omitempty"`
+}
+
+// DriftDetector periodically compares the cluster with the repository, to catch changes
+// which were never received as audit events.
+type DriftDetector struct {
+	cr       *CustomRepo
+	interval time.Duration
+	mode     DriftMode
+	mutex    sync.Mutex
+	last     *DriftReport
+}
+
+func NewDriftDetector(cr *CustomRepo) (*DriftDetector, error) {
+	d := &DriftDetector{
+		cr:       cr,
+		interval: cr.Config.Drift.Interval.Duration,
+		mode:     cr.Config.Drift.Mode,
+	}
+	if d.interval == 0 {
+		d.interval = defaultDriftInterval
+	}
+	switch d.mode {
+	case "":
+		d.mode = DriftModeReport
+	case DriftModeReport, DriftModeCommit:
+	default:
+		return nil, fmt.Errorf("unknown drift mode %q", d.mode)
+	}
+	return d, nil
+}
+
+// Run checks for drift at the configured interval until stopCh is closed. Periodic checks are
+// disabled when the interval is negative.
+func (d *DriftDetector) Run(stopCh <-chan struct{}) {
+	if d.interval < 0 {
+		return
+	}
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := d.Check(); err != nil {
+				klog.ErrorS(err, "unable to check for drift between cluster and repository")
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// Check compares the cluster with the repository HEAD and, in Commit mode, commits the
+// cluster state if they differ. Audit events for the drifted resources which are received
+// afterwards are ignored if they are older than the committed state.
+func (d *DriftDetector) Check() (*DriftReport, error) {
+	d.cr.Mutex.Lock()
+	defer d.cr.Mutex.Unlock()
+	report, err := d.cr.detectDrift()
+	if err != nil {
+		return nil, err
+	}
+	if len(report.Resources) > 0 {
+		klog.InfoS("drift detected between cluster and repository", "resources", len(report.Resources), "head", report.Head)
+		if d.mode == DriftModeCommit {
+			committed, err := d.cr.reconcileWithCluster(driftMessage(report))
+			if err != nil {
+				return nil, fmt.Errorf("unable to commit drifted resources: %w", err)
+			}
+			if committed {
+				head, err := d.cr.Repo.Head()
+				if err != nil {
+					return nil, fmt.Errorf("unable to get repo head: %w", err)
+				}
+				report.Commit = head.Hash().String()
+			}
+		}
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.last = report
+	return report, nil
+}
+
+// LastReport returns the result of the last check, or nil if no check has run yet.
+func (d *DriftDetector) LastReport() *DriftReport {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.last
+}
+
+func driftMessage(report *DriftReport) string {
+	lines := []string{driftCommitMessage, ""}
+	for _, r := range report.Resources {
+		lines = append(lines, string(r.Change)+" "+r.Path)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// detectDrift compares the canonical form of the tracked resources in the cluster with the
+// files at HEAD. It must be called with the repository mutex held.
+func (cr *CustomRepo) detectDrift() (*DriftReport, error) {
+	head, err := cr.Repo.Head()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get repo head: %w", err)
+	}
+	commit, err := cr.Repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("unable to get head commit: %w", err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get head tree: %w", err)
+	}
+	report := &DriftReport{Time: time.Now(), Head: head.Hash().String()}
+	live := map[string]bool{}
+	served := map[string]bool{}
+	for _, resource := range cr.Registry.Resources() {
+		list := &unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(resource.ListGroupVersionKind())
+		resources, err := cr.K8s.ListResource(list)
+		if isResourceNotServed(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("could not list resource APIVersion: %s Kind: %s: %w", list.GetAPIVersion(), list.GetKind(), err)
+		}
+		served[resource.Dir] = true
+		for i := range resources.Items {
+			item := &resources.Items[i]
+			path := computePath("", resource.Dir, item.GetNamespace(), item.GetName()+".yaml")
+			live[path] = true
+			y, err := cr.marshalResource(item)
+			if err != nil {
+				return nil, err
+			}
+			file, err := tree.File(path)
+			if err == object.ErrFileNotFound {
+				report.Resources = append(report.Resources, DriftedResource{Path: path, Change: DriftAdded})
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("unable to read file %s at head: %w", path, err)
+			}
+			contents, err := file.Contents()
+			if err != nil {
+				return nil, fmt.Errorf("unable to read file %s at head: %w", path, err)
+			}
+			if contents != string(y) {
+				report.Resources = append(report.Resources, DriftedResource{Path: path, Change: DriftModified})
+			}
+		}
+	}
+	err = tree.Files().ForEach(func(f *object.File) error {
+		dir := strings.SplitN(f.Name, "/", 2)[0]
+		if filepath.Ext(f.Name) != ".yaml" || !served[dir] || live[f.Name] {
+			return nil
+		}
+		report.Resources = append(report.Resources, DriftedResource{Path: f.Name, Change: DriftRemoved})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list files at head: %w", err)
+	}
+	sort.Slice(report.Resources, func(i, j int) bool {
+		return report.Resources[i].Path < report.Resources[j].Path
+	})
+	return report, nil
+}
@@ -0,0 +1,120 @@
+package gitops
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+type EventRuleAction string
+
+const (
+	EventRuleInclude EventRuleAction = "Include"
+	EventRuleExclude EventRuleAction = "Exclude"
+)
+
+// EventRule decides whether matching audit events are recorded in the repository. An event
+// matches a rule if it matches every non-empty field of the rule, and a field if it matches
+// any of its values. Patterns may use '*' to match any sequence of characters.
+type EventRule struct {
+	Action EventRuleAction `json:"action"`
+	// Users are patterns matched against the username.
+	Users []string `json:"users,omitempty"`
+	// Groups are patterns matched against the groups of the user.
+	Groups []string `json:"groups,omitempty"`
+	// Namespaces are patterns matched against the namespace of the resource. Cluster-scoped
+	// resources have an empty namespace.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// UserAgents are patterns matched against the user agent of the request.
+	UserAgents []string `json:"userAgents,omitempty"`
+	Verbs      []string `json:"verbs,omitempty"`
+}
+
+type compiledEventRule struct {
+	action     EventRuleAction
+	users      []*regexp.Regexp
+	groups     []*regexp.Regexp
+	namespaces []*regexp.Regexp
+	userAgents []*regexp.Regexp
+	verbs      []string
+}
+
+// eventFilter applies the ingestion rules in order: the first rule matching an event decides
+// whether it is recorded. Events matching no rule are recorded.
+type eventFilter struct {
+	rules []compiledEventRule
+}
+
+func newEventFilter(rules []EventRule) (*eventFilter, error) {
+	f := &eventFilter{}
+	for i, rule := range rules {
+		if rule.Action != EventRuleInclude && rule.Action != EventRuleExclude {
+			return nil, fmt.Errorf("ingestion rule %d: action must be %s or %s", i, EventRuleInclude, EventRuleExclude)
+		}
+		compiled := compiledEventRule{action: rule.Action, verbs: rule.Verbs}
+		compiled.users = compileGlobs(rule.Users)
+		compiled.groups = compileGlobs(rule.Groups)
+		compiled.namespaces = compileGlobs(rule.Namespaces)
+		compiled.userAgents = compileGlobs(rule.UserAgents)
+		f.rules = append(f.rules, compiled)
+	}
+	return f, nil
+}
+
+// includes returns true if the event should be recorded.
+func (f *eventFilter) includes(event auditv1.Event) bool {
+	for _, rule := range f.rules {
+		if rule.matches(event) {
+			return rule.action == EventRuleInclude
+		}
+	}
+	return true
+}
+
+func (r compiledEventRule) matches(event auditv1.Event) bool {
+	namespace := ""
+	if event.ObjectRef != nil {
+		namespace = event.ObjectRef.Namespace
+	}
+	if len(r.verbs) > 0 && !stringInSlice(event.Verb, r.verbs) {
+		return false
+	}
+	if len(r.users) > 0 && !matchAny(r.users, event.User.Username) {
+		return false
+	}
+	if len(r.groups) > 0 && !matchAny(r.groups, event.User.Groups...) {
+		return false
+	}
+	if len(r.namespaces) > 0 && !matchAny(r.namespaces, namespace) {
+		return false
+	}
+	if len(r.userAgents) > 0 && !matchAny(r.userAgents, event.UserAgent) {
+		return false
+	}
+	return true
+}
+
+func compileGlobs(patterns []string) []*regexp.Regexp {
+	var globs []*regexp.Regexp
+	for _, pattern := range patterns {
+		parts := strings.Split(pattern, "*")
+		for i := range parts {
+			parts[i] = regexp.QuoteMeta(parts[i])
+		}
+		globs = append(globs, regexp.MustCompile("^"+strings.Join(parts, ".*")+"$"))
+	}
+	return globs
+}
+
+func matchAny(globs []*regexp.Regexp, values ...string) bool {
+	for _, glob := range globs {
+		for _, value := range values {
+			if glob.MatchString(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -1,10 +1,10 @@
 package gitops
 
 import (
+	"errors"
+	"path/filepath"
+	"strings"
 	"time"
-    "fmt"
-    "errors"
-    "strings"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing/object"
@@ -24,73 +24,59 @@ func (cr *CustomRepo) FilterCommits(author *string, since *time.Time, until *tim
 	}
 
 	logopts.From = ref.Hash()
-	if !since.IsZero() && since != nil {
-		logopts.Since = since
+
+	if *resource != "" && *namespace == "" && *name != "" {
+		return filteredCommits, errors.New("error (FilterCommits): cannot provide a resource without a namespace")
 	}
-	if !since.IsZero() && until != nil {
-		logopts.Until = until
+	if *resource != "" || *namespace != "" || *name != "" {
+		logopts.PathFilter = func(path string) bool {
+			return matchPath(path, *resource, *namespace, *name)
+		}
 	}
+	return cr.filter(author, since, until, logopts)
+}
 
-	if *resource != "" && *namespace == "" && *name != "" {
-        return filteredCommits, errors.New("error (FilterCommits): cannot provide a resource without a namespace")
-    } else if *resource == "" && *namespace != "" {
-        resources := []string{"k8s-policies", "antrea-policies", "antrea-cluster-policies", "antrea-tiers"}
-        for _, r := range resources {
-            logopts.PathFilter = func(path string) bool {
-                tempPath := r + "/" + *namespace + "/" + *name
-                if strings.Contains(path, tempPath) {
-                    return true
-                }
-                fmt.Println("false: " + path)
-                fmt.Println(tempPath)
-                return false
-            }
-            tempCommits, err := cr.filter(author, logopts)
-            if err != nil {
-                return filteredCommits, err
-            }
-            for _, tc := range tempCommits {
-                filteredCommits = append(filteredCommits, tc)
-            }
-        }
-	} else {
-        filepath := ""
-        if *resource != "" {
-            filepath += *resource + "/"
-        }
-        if *namespace != "" {
-            filepath += *namespace + "/"
-        }
-        if *name != "" {
-            filepath += *name
-        }
-        if filepath != "" {
-            logopts.PathFilter = func(path string) bool {
-                if strings.Contains(path, filepath) {
-                    return true
-                }
-                fmt.Println("false: " + path)
-                fmt.Println(filepath)
-                return false
-            }
-        }
-        filteredCommits, err = cr.filter(author, logopts)
-    }
-    return filteredCommits, err
+// matchPath reports whether a repository path is the file of a resource matching the
+// resource directory, namespace and name, ignoring the empty ones.
+func matchPath(path string, resource string, namespace string, name string) bool {
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 || filepath.Ext(path) != ".yaml" {
+		return false
+	}
+	if resource != "" && parts[0] != resource {
+		return false
+	}
+	if namespace != "" && (len(parts) != 3 || parts[1] != namespace) {
+		return false
+	}
+	if name != "" && parts[len(parts)-1] != name+".yaml" {
+		return false
+	}
+	return true
 }
 
-func (cr *CustomRepo) filter(author *string, logopts git.LogOptions) ([]object.Commit, error) {
+// filter walks the log and keeps the commits matching author and whose author date (the time
+// of the audited change) falls between since and until. Log's own Since/Until options are not
+// used since they compare committer dates, i.e. the time the webhook processed the event.
+func (cr *CustomRepo) filter(author *string, since *time.Time, until *time.Time, logopts git.LogOptions) ([]object.Commit, error) {
 	var filteredCommits []object.Commit
-    cIter, err := cr.Repo.Log(&logopts)
+	cIter, err := cr.Repo.Log(&logopts)
 	if err != nil {
 		klog.ErrorS(err, "unable get logs from repository")
 		return filteredCommits, err
 	}
 
 	err = cIter.ForEach(func(c *object.Commit) error {
-		if *author == "" || c.Author.Name == *author {
-			filteredCommits = append(filteredCommits, *c)
+		if *author != "" && c.Author.Name != *author {
+			return nil
+		}
+		if since != nil && !since.IsZero() && c.Author.When.Before(*since) {
+			return nil
+		}
+		if until != nil && !until.IsZero() && c.Author.When.After(*until) {
+			return nil
 		}
+		filteredCommits = append(filteredCommits, *c)
 		return nil
 	})
 	return filteredCommits, err
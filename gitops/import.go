@@ -0,0 +1,126 @@
+package gitops
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/klog/v2"
+)
+
+// ImportSummary reports the outcome of ImportRepo.
+type ImportSummary struct {
+	// Events is the number of audit events of completed changes read, Failed the number which
+	// could not be applied.
+	Events int
+	Failed int
+	// Reconciled is true if the imported history differed from the cluster state.
+	Reconciled bool
+}
+
+// ParseEvents reads audit events from an audit log written with the JSON format (one event
+// per line) or from EventList JSON documents.
+func ParseEvents(data []byte) ([]auditv1.Event, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var events []auditv1.Event
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to decode audit events: %w", err)
+		}
+		typeMeta := metav1.TypeMeta{}
+		if err := json.Unmarshal(raw, &typeMeta); err != nil {
+			return nil, fmt.Errorf("unable to decode audit events: %w", err)
+		}
+		if typeMeta.Kind == "EventList" {
+			eventList := auditv1.EventList{}
+			if err := json.Unmarshal(raw, &eventList); err != nil {
+				return nil, fmt.Errorf("could not unmarshal event list json: %w", err)
+			}
+			events = append(events, eventList.Items...)
+			continue
+		}
+		event := auditv1.Event{}
+		if err := json.Unmarshal(raw, &event); err != nil {
+			return nil, fmt.Errorf("could not unmarshal event json: %w", err)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// ImportRepo creates a new repository in dir whose history is built from historical audit
+// events instead of a snapshot of the cluster. Events are committed in timestamp order with
+// their original authors, after which the repository is reconciled with the current state of
+// the cluster, since the audit logs may not cover every change.
+func ImportRepo(k8s *K8sClient, dir string, config *Config, events []auditv1.Event) (*CustomRepo, *ImportSummary, error) {
+	cr, storer, err := newCustomRepo(k8s, StorageModeDisk, dir, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := cr.createRepo(storer)
+	if err == git.ErrRepositoryAlreadyExists {
+		return nil, nil, fmt.Errorf("resource repository already exists in %s", dir)
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("unable to create resource repository: %w", err)
+	}
+	cr.Repo = r
+	// audit logs also hold read requests and the other stages of the changes
+	var changes []auditv1.Event
+	for _, event := range events {
+		if IsMutatingVerb(event.Verb) && event.Stage == auditv1.StageResponseComplete {
+			changes = append(changes, event)
+		}
+	}
+	events = changes
+	sort.SliceStable(events, func(i, j int) bool {
+		return getEventTime(events[i]).Before(getEventTime(events[j]))
+	})
+
+	cr.Mutex.Lock()
+	for _, resource := range cr.Registry.Resources() {
+		if err := cr.createResourceDir(resource); err != nil {
+			cr.Mutex.Unlock()
+			return nil, nil, fmt.Errorf("unable to create directory for resource type %s: %w", resource.GroupVersionKind().String(), err)
+		}
+	}
+	start := time.Now()
+	if len(events) > 0 {
+		start = getEventTime(events[0])
+	}
+	err = cr.commitEmpty(systemUsername, systemEmail, "Start of imported audit history", start)
+	cr.Mutex.Unlock()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create initial commit: %w", err)
+	}
+
+	summary := &ImportSummary{Events: len(events)}
+	for _, event := range events {
+		// events are applied one at a time so that a single invalid event does not prevent
+		// the rest of the history from being imported
+		if err := cr.HandleEvents([]auditv1.Event{event}); err != nil {
+			klog.ErrorS(err, "unable to import audit event", "auditID", event.AuditID)
+			summary.Failed++
+		}
+	}
+
+	cr.Mutex.Lock()
+	defer cr.Mutex.Unlock()
+	summary.Reconciled, err = cr.reconcileWithCluster("Reconcile imported history with cluster state")
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to reconcile imported history with cluster: %w", err)
+	}
+	if err := cr.versions.save(); err != nil {
+		return nil, nil, fmt.Errorf("unable to save resource versions: %w", err)
+	}
+	return cr, summary, nil
+}
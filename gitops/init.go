@@ -19,8 +19,8 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
-	"github.com/ghodss/yaml"
 	billy "github.com/go-git/go-billy/v5"
 	memfs "github.com/go-git/go-billy/v5/memfs"
 	"github.com/go-git/go-billy/v5/osfs"
@@ -30,7 +30,6 @@ import (
 	"github.com/go-git/go-git/v5/storage/filesystem"
 	memory "github.com/go-git/go-git/v5/storage/memory"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/klog/v2"
 )
 
@@ -41,70 +40,53 @@ const (
 	StorageModeInMemory StorageModeType = "InMemory"
 )
 
-var gvkDirMap = map[schema.GroupVersionKind]string{
-	{Group: "networking.k8s.io",
-		Version: "v1",
-		Kind:    "NetworkPolicyList",
-	}: "k8s-policies",
-	{Group: "crd.antrea.io",
-		Version: "v1alpha1",
-		Kind:    "NetworkPolicyList",
-	}: "antrea-policies",
-	{Group: "crd.antrea.io",
-		Version: "v1alpha1",
-		Kind:    "ClusterNetworkPolicyList",
-	}: "antrea-cluster-policies",
-	{Group: "crd.antrea.io",
-		Version: "v1alpha1",
-		Kind:    "TierList",
-	}: "antrea-tiers",
-}
-
-func getAllResourceListTypes() []schema.GroupVersionKind {
-	return []schema.GroupVersionKind{
-		{
-			Group:   "networking.k8s.io",
-			Version: "v1",
-			Kind:    "NetworkPolicyList",
-		},
-		{
-			Group:   "crd.antrea.io",
-			Version: "v1alpha1",
-			Kind:    "NetworkPolicyList",
-		},
-		{
-			Group:   "crd.antrea.io",
-			Version: "v1alpha1",
-			Kind:    "ClusterNetworkPolicyList",
-		},
-		{
-			Group:   "crd.antrea.io",
-			Version: "v1alpha1",
-			Kind:    "TierList",
-		},
-	}
-}
+const (
+	systemUsername = "audit-init"
+	systemEmail    = "system@audit.antrea.io"
+)
 
 type CustomRepo struct {
 	Repo           *git.Repository
 	K8s            *K8sClient
+	Config         *Config
+	Registry       *ResourceRegistry
 	RollbackMode   bool
 	ServiceAccount string
 	Fs             billy.Filesystem
 	Mutex          sync.Mutex
+	// stateFs holds bookkeeping state that is not part of the resource history
+	stateFs     billy.Filesystem
+	auditIDs    *auditIndex
+	versions    *versionIndex
+	journal     *eventJournal
+	scrubber    *scrubber
+	eventFilter *eventFilter
+	// offlineChangesPending is set when the offline changes could not be recorded at startup
+	// because earlier audit events could not be applied.
+	offlineChangesPending bool
 }
 
 func SetupRepo(k8s *K8sClient, mode StorageModeType, dir string) (*CustomRepo, error) {
-	storer, fs, err := setupStorage(dir, mode)
+	return SetupRepoWithConfig(k8s, mode, dir, DefaultConfig())
+}
+
+func SetupRepoWithConfig(k8s *K8sClient, mode StorageModeType, dir string, config *Config) (*CustomRepo, error) {
+	return setupRepo(k8s, mode, dir, config, "")
+}
+
+// SetupClusterRepo sets up the repository of one of the clusters listed in the config, in the
+// directory returned by ClusterDir.
+func SetupClusterRepo(k8s *K8sClient, dir string, config *Config, cluster ClusterConfig) (*CustomRepo, error) {
+	return setupRepo(k8s, StorageModeDisk, ClusterDir(dir, cluster.Name), config, cluster.Username)
+}
+
+func setupRepo(k8s *K8sClient, mode StorageModeType, dir string, config *Config, serviceAccount string) (*CustomRepo, error) {
+	cr, storer, err := newCustomRepo(k8s, mode, dir, config)
 	if err != nil {
-		return nil, fmt.Errorf("unable to set up filesystem/storer backend for repo")
+		return nil, err
 	}
-	svcAcct := "system:serviceaccount:" + GetAuditPodNamespace() + ":" + GetAuditServiceAccount()
-	cr := CustomRepo{
-		K8s:            k8s,
-		RollbackMode:   false,
-		ServiceAccount: svcAcct,
-		Fs:             fs,
+	if serviceAccount != "" {
+		cr.ServiceAccount = serviceAccount
 	}
 	cr.Mutex.Lock()
 	defer cr.Mutex.Unlock()
@@ -112,23 +94,67 @@ func SetupRepo(k8s *K8sClient, mode StorageModeType, dir string) (*CustomRepo, e
 	cr.Repo = r
 	if err == git.ErrRepositoryAlreadyExists {
 		klog.V(2).InfoS("resource repository already exists - skipping initialization")
-		return &cr, nil
+		if err := cr.loadAuditIndex(); err != nil {
+			return nil, fmt.Errorf("unable to load processed audit IDs: %w", err)
+		}
+		if err := cr.versions.load(); err != nil {
+			return nil, fmt.Errorf("unable to load resource versions: %w", err)
+		}
+		return cr, nil
 	} else if err != nil {
 		return nil, fmt.Errorf("unable to create resource repository: %w", err)
 	}
-	if err := cr.addAllResources(); err != nil {
+	if _, _, err := cr.addAllResources(); err != nil {
 		return nil, fmt.Errorf("unable to add resource yamls to repository: %w", err)
 	}
-	if err := cr.AddAndCommit("audit-init", "system@audit.antrea.io", "Initial commit of existing policies"); err != nil {
+	if err := cr.commitEmpty(systemUsername, systemEmail, "Initial commit of existing policies", time.Now()); err != nil {
 		return nil, fmt.Errorf("unable to add/commit existing reosurces to repository: %w", err)
 	}
+	if err := cr.versions.save(); err != nil {
+		return nil, fmt.Errorf("unable to save resource versions: %w", err)
+	}
 	klog.V(2).Infof("repository successfully initialized at %s", dir)
-	return &cr, nil
+	return cr, nil
+}
+
+func newCustomRepo(k8s *K8sClient, mode StorageModeType, dir string, config *Config) (*CustomRepo, storage.Storer, error) {
+	registry, err := NewResourceRegistry(config.Resources)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid tracked resource configuration: %w", err)
+	}
+	eventFilter, err := newEventFilter(config.Ingestion.Rules)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid ingestion configuration: %w", err)
+	}
+	scrubber, err := newScrubber(config.Scrub)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid scrub configuration: %w", err)
+	}
+	storer, fs, stateFs, err := setupStorage(dir, mode)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to set up filesystem/storer backend for repo")
+	}
+	svcAcct := "system:serviceaccount:" + GetAuditPodNamespace() + ":" + GetAuditServiceAccount()
+	cr := &CustomRepo{
+		K8s:            k8s,
+		Config:         config,
+		Registry:       registry,
+		RollbackMode:   false,
+		ServiceAccount: svcAcct,
+		Fs:             fs,
+		stateFs:        stateFs,
+		auditIDs:       newAuditIndex(stateFs, defaultAuditIndexSize),
+		versions:       newVersionIndex(stateFs),
+		journal:        newEventJournal(stateFs, rollbackJournalFile),
+		scrubber:       scrubber,
+		eventFilter:    eventFilter,
+	}
+	return cr, storer, nil
 }
 
-func setupStorage(dir string, mode StorageModeType) (storage.Storer, billy.Filesystem, error) {
+func setupStorage(dir string, mode StorageModeType) (storage.Storer, billy.Filesystem, billy.Filesystem, error) {
 	var storer storage.Storer
-	var worktreeFs, storerFs billy.Filesystem
+	var worktreeFs, storerFs, stateFs billy.Filesystem
 	if mode == StorageModeDisk {
 		if dir == "" {
 			dir, _ = os.Getwd()
@@ -137,13 +163,15 @@ func setupStorage(dir string, mode StorageModeType) (storage.Storer, billy.Files
 		worktreeFs = osfs.New(dir)
 		storerFs = osfs.New(filepath.Join(dir, ".git"))
 		storer = filesystem.NewStorage(storerFs, cache.NewObjectLRUDefault())
+		stateFs = osfs.New(filepath.Join(dir, ".git", "audit"))
 	} else if mode == StorageModeInMemory {
 		worktreeFs = memfs.New()
 		storer = memory.NewStorage()
+		stateFs = memfs.New()
 	} else {
-		return nil, nil, fmt.Errorf("mode must be memory(mem) or disk(disk), '%s' is not valid", mode)
+		return nil, nil, nil, fmt.Errorf("mode must be memory(mem) or disk(disk), '%s' is not valid", mode)
 	}
-	return storer, worktreeFs, nil
+	return storer, worktreeFs, stateFs, nil
 }
 
 func (cr *CustomRepo) createRepo(storer storage.Storer) (*git.Repository, error) {
@@ -157,50 +185,66 @@ func (cr *CustomRepo) createRepo(storer storage.Storer) (*git.Repository, error)
 	return r, nil
 }
 
-func (cr *CustomRepo) addAllResources() error {
-	for _, resourceListType := range getAllResourceListTypes() {
-		if err := cr.createResourceDir(resourceListType); err != nil {
-			return fmt.Errorf("unable to create directory for resource type %s: %w", resourceListType.String(), err)
+// addAllResources writes the tracked resources currently in the cluster to the worktree and
+// returns the paths of the files written, and the directories of the resource types served by
+// the cluster.
+func (cr *CustomRepo) addAllResources() (map[string]bool, map[string]bool, error) {
+	written := map[string]bool{}
+	served := map[string]bool{}
+	for _, resource := range cr.Registry.Resources() {
+		if err := cr.createResourceDir(resource); err != nil {
+			return nil, nil, fmt.Errorf("unable to create directory for resource type %s: %w", resource.GroupVersionKind().String(), err)
+		}
+		ok, err := cr.addResource(resource, written)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to add resources for type %s: %w", resource.GroupVersionKind().String(), err)
 		}
-		if err := cr.addResource(resourceListType); err != nil {
-			return fmt.Errorf("unable to add resources for type %s: %w", resourceListType.String(), err)
+		if ok {
+			served[resource.Dir] = true
 		}
 	}
-	return nil
+	return written, served, nil
 }
 
-func (cr *CustomRepo) addResource(resourceList schema.GroupVersionKind) error {
+// addResource writes the resources of a tracked type to the worktree. It returns false if the
+// type is not served by the cluster.
+func (cr *CustomRepo) addResource(resource TrackedResource, written map[string]bool) (bool, error) {
 	list := &unstructured.UnstructuredList{}
-	list.SetGroupVersionKind(resourceList)
+	list.SetGroupVersionKind(resource.ListGroupVersionKind())
 	resources, err := cr.K8s.ListResource(list)
-	if err != nil {
-		return fmt.Errorf("could not list resource APIVersion: %s Kind: %s: %w", list.GetAPIVersion(), list.GetKind(), err)
+	if isResourceNotServed(err) {
+		klog.V(2).InfoS("resource type is not served by the cluster, skipping", "apiVersion", list.GetAPIVersion(), "kind", list.GetKind())
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("could not list resource APIVersion: %s Kind: %s: %w", list.GetAPIVersion(), list.GetKind(), err)
 	}
 	var namespaces []string
 	for i, np := range resources.Items {
-		clearFields(&resources.Items[i])
+		version := objectVersion{ResourceVersion: np.GetResourceVersion()}
 		name := np.GetName()
 		namespace := np.GetNamespace()
 		if !stringInSlice(namespace, namespaces) {
 			namespaces = append(namespaces, namespace)
-			namespaceDir := computePath("", gvkDirMap[resourceList], namespace, "")
+			namespaceDir := computePath("", resource.Dir, namespace, "")
 			cr.Fs.MkdirAll(namespaceDir, 0700)
 		}
-		path := computePath("", gvkDirMap[resourceList], namespace, name+".yaml")
-		y, err := yaml.Marshal(&resources.Items[i])
+		path := computePath("", resource.Dir, namespace, name+".yaml")
+		y, err := cr.marshalResource(&resources.Items[i])
 		if err != nil {
-			return fmt.Errorf("could not marshal resource config: %w", err)
+			return false, err
 		}
 		if err := cr.writeFileToPath(path, y); err != nil {
-			return fmt.Errorf("could not write yaml to path %s: %w", path, err)
+			return false, fmt.Errorf("could not write yaml to path %s: %w", path, err)
 		}
+		cr.versions.set(path, version)
+		written[path] = true
 		klog.V(2).InfoS("added resource", "path", path)
 	}
-	return nil
+	return true, nil
 }
 
-func (cr *CustomRepo) createResourceDir(resourceList schema.GroupVersionKind) error {
-	resourceDir := computePath("", gvkDirMap[resourceList], "", "")
+func (cr *CustomRepo) createResourceDir(resource TrackedResource) error {
+	resourceDir := computePath("", resource.Dir, "", "")
 	err := cr.Fs.MkdirAll(resourceDir, 0700)
 	if err != nil {
 		return fmt.Errorf("unable to create resource directory: %w", err)
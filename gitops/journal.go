@@ -0,0 +1,135 @@
+package gitops
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	billy "github.com/go-git/go-billy/v5"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	rollbackJournalFile = "rollback-journal.jsonl"
+	// deadLetterJournalFile holds the spooled events which can never be applied.
+	deadLetterJournalFile = "rollback-journal-dead-letter.jsonl"
+)
+
+// eventJournal durably spools audit events received while a rollback is in progress, one
+// JSON-encoded event per line, until they can be applied to the repository.
+type eventJournal struct {
+	fs   billy.Filesystem
+	name string
+}
+
+func newEventJournal(fs billy.Filesystem, name string) *eventJournal {
+	return &eventJournal{fs: fs, name: name}
+}
+
+func (j *eventJournal) append(events []auditv1.Event) error {
+	f, err := j.fs.OpenFile(j.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open rollback journal: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	for _, event := range events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("unable to marshal audit event %s: %w", event.AuditID, err)
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write rollback journal: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unable to write rollback journal: %w", err)
+	}
+	return nil
+}
+
+func (j *eventJournal) read() ([]auditv1.Event, error) {
+	f, err := j.fs.Open(j.name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to open rollback journal: %w", err)
+	}
+	defer f.Close()
+	var events []auditv1.Event
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		event := auditv1.Event{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			// a crash while appending can leave a truncated last line
+			klog.ErrorS(err, "skipping unreadable rollback journal entry")
+			continue
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read rollback journal: %w", err)
+	}
+	return events, nil
+}
+
+func (j *eventJournal) clear() error {
+	if err := j.fs.Remove(j.name); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to remove rollback journal: %w", err)
+	}
+	return nil
+}
+
+// replayJournal applies the audit events spooled during a rollback, in the order in which
+// they were received. Events which can never be applied are moved to the dead-letter journal;
+// otherwise the journal is only cleared once all its events have been applied. It must be
+// called with the repository mutex held and RollbackMode unset.
+func (cr *CustomRepo) replayJournal() error {
+	events, err := cr.journal.read()
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	klog.InfoS("replaying audit events received during rollback", "count", len(events))
+	pending, _ := cr.filterEvents(events)
+	err = cr.applyBatches(pending)
+	if errors.Is(err, ErrUnsupportedEvent) {
+		// the events are applied one by one to set aside the ones which can never be applied,
+		// events already committed are skipped by their audit ID
+		pending, _ = cr.filterEvents(pending)
+		err = cr.applyEachEvent(pending)
+	}
+	if err != nil {
+		// the journal is kept so that the next replay retries it
+		return fmt.Errorf("unable to apply audit events received during rollback: %w", err)
+	}
+	return cr.journal.clear()
+}
+
+func (cr *CustomRepo) applyEachEvent(events []auditv1.Event) error {
+	deadLetters := newEventJournal(cr.stateFs, deadLetterJournalFile)
+	for _, event := range events {
+		err := cr.applyEvents([]auditv1.Event{event})
+		if errors.Is(err, ErrUnsupportedEvent) {
+			klog.ErrorS(err, "unable to apply audit event received during rollback, moving it to the dead-letter journal", "auditID", event.AuditID)
+			if err := deadLetters.append([]auditv1.Event{event}); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package gitops
+
+import (
+	"strings"
+	"time"
+
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+const (
+	sourceIPsTrailer        = "Source-IPs"
+	userAgentTrailer        = "User-Agent"
+	requestURITrailer       = "Request-URI"
+	groupsTrailer           = "Groups"
+	impersonatedUserTrailer = "Impersonated-User"
+	reconstructedTrailer    = "Reconstructed"
+)
+
+// Provenance describes the request that produced a commit, as recorded in its trailers.
+type Provenance struct {
+	AuditID          string   `json:"auditID,omitempty"`
+	ResourceVersion  string   `json:"resourceVersion,omitempty"`
+	SourceIPs        []string `json:"sourceIPs,omitempty"`
+	UserAgent        string   `json:"userAgent,omitempty"`
+	RequestURI       string   `json:"requestURI,omitempty"`
+	Groups           []string `json:"groups,omitempty"`
+	ImpersonatedUser string   `json:"impersonatedUser,omitempty"`
+	// Reconstructed is true when the audit event did not include the resulting object and the
+	// committed state was read from the cluster after the change.
+	Reconstructed bool `json:"reconstructed,omitempty"`
+}
+
+// eventTrailers returns the commit trailers recording the provenance of an audit event.
+func eventTrailers(event auditv1.Event, version objectVersion) [][2]string {
+	impersonatedUser := ""
+	if event.ImpersonatedUser != nil {
+		impersonatedUser = event.ImpersonatedUser.Username
+	}
+	return [][2]string{
+		{auditIDTrailer, string(event.AuditID)},
+		{resourceVersionTrailer, version.ResourceVersion},
+		{sourceIPsTrailer, strings.Join(event.SourceIPs, ", ")},
+		{userAgentTrailer, trailerValue(event.UserAgent)},
+		{requestURITrailer, trailerValue(event.RequestURI)},
+		{groupsTrailer, strings.Join(event.User.Groups, ", ")},
+		{impersonatedUserTrailer, impersonatedUser},
+	}
+}
+
+// getEventTime returns the time at which the audited change happened.
+func getEventTime(event auditv1.Event) time.Time {
+	if !event.StageTimestamp.IsZero() {
+		return event.StageTimestamp.Time
+	}
+	if !event.RequestReceivedTimestamp.IsZero() {
+		return event.RequestReceivedTimestamp.Time
+	}
+	return time.Now()
+}
+
+// trailerValue keeps a value on a single line so it cannot break the trailer block.
+func trailerValue(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
+
+// ParseProvenance extracts the provenance trailers from a commit message. Commits that were
+// not produced from an audit event (e.g. the initial commit or rollbacks) yield an empty
+// Provenance.
+func ParseProvenance(message string) Provenance {
+	return Provenance{
+		AuditID:          getTrailer(message, auditIDTrailer),
+		ResourceVersion:  getTrailer(message, resourceVersionTrailer),
+		SourceIPs:        splitTrailerList(getTrailer(message, sourceIPsTrailer)),
+		UserAgent:        getTrailer(message, userAgentTrailer),
+		RequestURI:       getTrailer(message, requestURITrailer),
+		Groups:           splitTrailerList(getTrailer(message, groupsTrailer)),
+		ImpersonatedUser: getTrailer(message, impersonatedUserTrailer),
+		Reconstructed:    getTrailer(message, reconstructedTrailer) == "true",
+	}
+}
+
+func splitTrailerList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
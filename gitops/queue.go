@@ -0,0 +1,320 @@
+package gitops
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	billy "github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"k8s.io/klog/v2"
+)
+
+const (
+	queueDir         = "queue"
+	deadLetterDir    = "queue-dead-letter"
+	defaultQueueSize = 1000
+
+	queueMinRetryInterval = time.Second
+	queueMaxRetryInterval = time.Minute
+)
+
+var (
+	// ErrQueueFull is returned by Enqueue when the ingestion queue has reached its capacity.
+	ErrQueueFull = errors.New("ingestion queue is full")
+	// ErrInvalidEventList is returned by Enqueue when the request is not an audit event list.
+	ErrInvalidEventList = errors.New("invalid audit event list")
+)
+
+// EventQueue is a bounded, persistent queue of audit event lists waiting to be applied to the
+// repository. Each list is stored as a file in the repository's state directory until it has
+// been handled, so that acknowledged events survive a restart of the webhook.
+type EventQueue struct {
+	cr       *CustomRepo
+	fs       billy.Filesystem
+	capacity int
+	mutex    sync.Mutex
+	pending  []string
+	next     uint64
+	notify   chan struct{}
+	// failures is the number of consecutive failed attempts to apply the list at the head
+	// of the queue, and lastError the error of the last attempt.
+	failures  int
+	lastError string
+	// deadLettered is the number of event lists moved to the dead-letter directory because
+	// they contain events which can never be applied.
+	deadLettered int
+}
+
+// NewEventQueue creates the ingestion queue of a repository, reloading any event lists left
+// pending by a previous run.
+func NewEventQueue(cr *CustomRepo) (*EventQueue, error) {
+	capacity := cr.Config.Ingestion.QueueSize
+	if capacity <= 0 {
+		capacity = defaultQueueSize
+	}
+	if err := cr.stateFs.MkdirAll(queueDir, 0700); err != nil {
+		return nil, fmt.Errorf("unable to create queue directory: %w", err)
+	}
+	q := &EventQueue{
+		cr:       cr,
+		fs:       cr.stateFs,
+		capacity: capacity,
+		notify:   make(chan struct{}, 1),
+	}
+	files, err := q.fs.ReadDir(queueDir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read queue directory: %w", err)
+	}
+	for _, f := range files {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), ".json"), 10, 64)
+		if err != nil || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		q.pending = append(q.pending, f.Name())
+		if seq >= q.next {
+			q.next = seq + 1
+		}
+	}
+	sort.Strings(q.pending)
+	deadLetters, err := q.fs.ReadDir(deadLetterDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unable to read dead-letter directory: %w", err)
+	}
+	q.deadLettered = len(deadLetters)
+	if len(q.pending) > 0 {
+		klog.InfoS("reloaded pending audit event lists", "count", len(q.pending))
+		q.notify <- struct{}{}
+	}
+	return q, nil
+}
+
+// Enqueue validates and persists an audit event list. It returns ErrQueueFull when the queue
+// has reached its capacity.
+func (q *EventQueue) Enqueue(jsonstring []byte) error {
+	if _, err := unmarshalEventList(jsonstring); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEventList, err)
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.pending) >= q.capacity {
+		return ErrQueueFull
+	}
+	name := fmt.Sprintf("%020d.json", q.next)
+	if err := writeFileAtomic(q.fs, filepath.Join(queueDir, name), jsonstring); err != nil {
+		return fmt.Errorf("unable to persist audit event list: %w", err)
+	}
+	q.next++
+	q.pending = append(q.pending, name)
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Len returns the number of event lists waiting to be applied.
+func (q *EventQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.pending)
+}
+
+func (q *EventQueue) Capacity() int {
+	return q.capacity
+}
+
+// Failures returns the number of consecutive failed attempts to apply the event list at the
+// head of the queue, and the error of the last attempt.
+func (q *EventQueue) Failures() (int, string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.failures, q.lastError
+}
+
+// DeadLettered returns the number of event lists moved out of the queue because they contain
+// events which can never be applied.
+func (q *EventQueue) DeadLettered() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.deadLettered
+}
+
+// OfflineChangesPending returns true while the changes made when the webhook was not running
+// wait for the queue to be drained before being recorded.
+func (q *EventQueue) OfflineChangesPending() bool {
+	return q.cr.OfflineChangesPending()
+}
+
+// Run applies queued event lists to the repository in order until stopCh is closed. Lists
+// which cannot be parsed are logged and dropped, and lists containing events which can never
+// be applied are moved to the dead-letter directory. Other lists which cannot be applied stay
+// at the head of the queue and are retried with an exponential backoff, since their events
+// have already been acknowledged.
+func (q *EventQueue) Run(stopCh <-chan struct{}) {
+	for {
+		name, ok := q.peek()
+		if !ok {
+			if err := q.cr.recordPendingOfflineChanges(); err != nil {
+				klog.ErrorS(err, "unable to record changes made while the audit webhook was not running")
+			}
+			select {
+			case <-q.notify:
+				continue
+			case <-stopCh:
+				return
+			}
+		}
+		err := q.handle(name)
+		if errors.Is(err, ErrInvalidEventList) {
+			klog.ErrorS(err, "unable to parse queued audit event list, dropping it", "file", name)
+		} else if errors.Is(err, ErrUnsupportedEvent) {
+			klog.ErrorS(err, "unable to apply queued audit event list, moving it to the dead-letter directory", "file", name)
+			if err = q.deadLetter(name); err == nil {
+				continue
+			}
+			klog.ErrorS(err, "unable to move audit event list to the dead-letter directory, dropping it", "file", name)
+		} else if err != nil {
+			retryInterval := q.recordFailure(err)
+			klog.ErrorS(err, "unable to process audit event list, retrying", "file", name, "retryInterval", retryInterval)
+			select {
+			case <-time.After(retryInterval):
+				continue
+			case <-stopCh:
+				return
+			}
+		}
+		if err := q.remove(name); err != nil {
+			klog.ErrorS(err, "unable to remove audit event list from queue", "file", name)
+		}
+	}
+}
+
+// recordFailure records a failed attempt to apply the head of the queue and returns the time
+// to wait before the next attempt.
+func (q *EventQueue) recordFailure(err error) time.Duration {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.failures++
+	q.lastError = err.Error()
+	retryInterval := queueMinRetryInterval
+	for i := 1; i < q.failures && retryInterval < queueMaxRetryInterval; i++ {
+		retryInterval *= 2
+	}
+	if retryInterval > queueMaxRetryInterval {
+		retryInterval = queueMaxRetryInterval
+	}
+	return retryInterval
+}
+
+func (q *EventQueue) peek() (string, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.pending) == 0 {
+		return "", false
+	}
+	return q.pending[0], true
+}
+
+func (q *EventQueue) handle(name string) error {
+	f, err := q.fs.Open(filepath.Join(queueDir, name))
+	if err != nil {
+		return fmt.Errorf("unable to open queued event list: %w", err)
+	}
+	defer f.Close()
+	jsonstring, err := ioutil.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("unable to read queued event list: %w", err)
+	}
+	eventList, err := unmarshalEventList(jsonstring)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEventList, err)
+	}
+	return q.cr.HandleEvents(eventList.Items)
+}
+
+// deadLetter moves the event list at the head of the queue to the dead-letter directory.
+func (q *EventQueue) deadLetter(name string) error {
+	if err := moveToDeadLetter(q.fs, name); err != nil {
+		return err
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.pending = q.pending[1:]
+	q.failures = 0
+	q.lastError = ""
+	q.deadLettered++
+	return nil
+}
+
+func moveToDeadLetter(fs billy.Filesystem, name string) error {
+	if err := fs.MkdirAll(deadLetterDir, 0700); err != nil {
+		return fmt.Errorf("unable to create dead-letter directory: %w", err)
+	}
+	if err := fs.Rename(filepath.Join(queueDir, name), filepath.Join(deadLetterDir, name)); err != nil {
+		return fmt.Errorf("unable to move audit event list to the dead-letter directory: %w", err)
+	}
+	return nil
+}
+
+func (q *EventQueue) remove(name string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.pending = q.pending[1:]
+	q.failures = 0
+	q.lastError = ""
+	return q.fs.Remove(filepath.Join(queueDir, name))
+}
+
+// drainQueue applies the event lists left in the queue by a previous run, without starting a
+// queue. Lists which cannot be parsed are dropped, and lists containing events which can never
+// be applied are moved to the dead-letter directory. It stops at the first other list which
+// cannot be applied, leaving it and the following lists in the queue to be retried by the
+// queue worker, and returns false in that case. It must be called with the repository mutex
+// held.
+func (cr *CustomRepo) drainQueue() (bool, error) {
+	files, err := cr.stateFs.ReadDir(queueDir)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, fmt.Errorf("unable to read queue directory: %w", err)
+	}
+	var names []string
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".json") {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := filepath.Join(queueDir, name)
+		jsonstring, err := util.ReadFile(cr.stateFs, path)
+		if err != nil {
+			return false, fmt.Errorf("unable to read queued event list: %w", err)
+		}
+		eventList, err := unmarshalEventList(jsonstring)
+		if err != nil {
+			klog.ErrorS(err, "unable to parse queued audit event list, dropping it", "file", name)
+		} else if err := cr.handleEvents(eventList.Items); errors.Is(err, ErrUnsupportedEvent) {
+			klog.ErrorS(err, "unable to apply queued audit event list, moving it to the dead-letter directory", "file", name)
+			if err := moveToDeadLetter(cr.stateFs, name); err != nil {
+				return false, err
+			}
+			continue
+		} else if err != nil {
+			klog.ErrorS(err, "unable to process queued audit event list, leaving it in the queue", "file", name)
+			return false, nil
+		}
+		if err := cr.stateFs.Remove(path); err != nil {
+			return false, fmt.Errorf("unable to remove audit event list from queue: %w", err)
+		}
+	}
+	return true, nil
+}
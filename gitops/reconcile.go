@@ -0,0 +1,124 @@
+package gitops
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const offlineChangesMessage = "Offline changes: update repository to match cluster state"
+
+// RecordOfflineChanges brings the repository up to date when the webhook starts, before it
+// accepts new events: the audit events received but not applied before it stopped are applied
+// first, then the changes made while it was not running are committed. If some of these
+// events cannot be applied yet, they are kept to be retried and the offline changes are only
+// committed once the queue has been drained, so that they are not attributed to the system
+// instead of the users who made them.
+func (cr *CustomRepo) RecordOfflineChanges() error {
+	cr.Mutex.Lock()
+	defer cr.Mutex.Unlock()
+	if err := cr.replayJournal(); err != nil {
+		klog.ErrorS(err, "unable to replay audit events received during rollback, not recording offline changes yet")
+		cr.offlineChangesPending = true
+		return nil
+	}
+	drained, err := cr.drainQueue()
+	if err != nil {
+		return fmt.Errorf("unable to apply queued audit events: %w", err)
+	}
+	if !drained {
+		klog.ErrorS(nil, "queued audit events could not be applied, not recording offline changes yet")
+		cr.offlineChangesPending = true
+		return nil
+	}
+	return cr.recordOfflineChanges()
+}
+
+// OfflineChangesPending returns true if the changes made while the webhook was not running have
+// not been recorded yet.
+func (cr *CustomRepo) OfflineChangesPending() bool {
+	cr.Mutex.Lock()
+	defer cr.Mutex.Unlock()
+	return cr.offlineChangesPending
+}
+
+// recordPendingOfflineChanges records the offline changes which could not be recorded at
+// startup. It is called by the queue worker once the queue has been drained.
+func (cr *CustomRepo) recordPendingOfflineChanges() error {
+	cr.Mutex.Lock()
+	defer cr.Mutex.Unlock()
+	if !cr.offlineChangesPending || cr.RollbackMode {
+		return nil
+	}
+	if err := cr.replayJournal(); err != nil {
+		return err
+	}
+	return cr.recordOfflineChanges()
+}
+
+func (cr *CustomRepo) recordOfflineChanges() error {
+	committed, err := cr.reconcileWithCluster(offlineChangesMessage)
+	if err != nil {
+		return err
+	}
+	cr.offlineChangesPending = false
+	if committed {
+		klog.InfoS("recorded changes made while the audit webhook was not running")
+	}
+	return nil
+}
+
+// reconcileWithCluster updates the worktree to match the tracked resources currently in the
+// cluster and commits the difference, if any. It returns true if a commit was created. It must
+// be called with the repository mutex held.
+func (cr *CustomRepo) reconcileWithCluster(message string) (bool, error) {
+	w, err := cr.Repo.Worktree()
+	if err != nil {
+		return false, fmt.Errorf("unable to get git worktree from repository: %w", err)
+	}
+	written, served, err := cr.addAllResources()
+	if err != nil {
+		return false, fmt.Errorf("unable to add cluster resources to repository: %w", err)
+	}
+	// the files of resource types which are not served, e.g. because their CRD is missing or
+	// briefly unavailable, are kept
+	var existing []string
+	for _, dir := range cr.Registry.Dirs() {
+		if !served[dir] {
+			continue
+		}
+		paths, err := cr.listResourceFiles(dir)
+		if err != nil {
+			return false, err
+		}
+		existing = append(existing, paths...)
+	}
+	for _, path := range existing {
+		if written[path] {
+			continue
+		}
+		if _, err := w.Remove(path); err != nil {
+			return false, fmt.Errorf("unable to remove file at: %s: %w", path, err)
+		}
+		cr.versions.setDeleted(path, objectVersion{Timestamp: time.Now()})
+		klog.V(2).InfoS("removed resource missing from the cluster", "path", path)
+	}
+	if _, err := w.Add("."); err != nil {
+		return false, fmt.Errorf("unable to add git change to worktree: %w", err)
+	}
+	status, err := w.Status()
+	if err != nil {
+		return false, fmt.Errorf("unable to get worktree status: %w", err)
+	}
+	if status.IsClean() {
+		return false, nil
+	}
+	if err := cr.AddAndCommit(systemUsername, systemEmail, message); err != nil {
+		return false, fmt.Errorf("unable to commit reconciled resources: %w", err)
+	}
+	if err := cr.versions.save(); err != nil {
+		klog.ErrorS(err, "unable to persist resource versions")
+	}
+	return true, nil
+}
@@ -0,0 +1,200 @@
+package gitops
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+// TrackedResource describes a resource kind whose objects are recorded in the repository.
+// Version is the API version used to list objects; objects and audit events using one of
+// the AltVersions are accepted as well.
+type TrackedResource struct {
+	Group       string   `json:"group"`
+	Version     string   `json:"version"`
+	AltVersions []string `json:"altVersions,omitempty"`
+	Kind        string   `json:"kind"`
+	Resource    string   `json:"resource"`
+	Namespaced  bool     `json:"namespaced"`
+	Dir         string   `json:"dir"`
+	DisplayName string   `json:"displayName"`
+}
+
+func (t TrackedResource) GroupVersionKind() schema.GroupVersionKind {
+	return schema.GroupVersionKind{Group: t.Group, Version: t.Version, Kind: t.Kind}
+}
+
+func (t TrackedResource) ListGroupVersionKind() schema.GroupVersionKind {
+	return schema.GroupVersionKind{Group: t.Group, Version: t.Version, Kind: t.Kind + "List"}
+}
+
+// GroupVersionKinds returns the kind in all of its accepted API versions.
+func (t TrackedResource) GroupVersionKinds() []schema.GroupVersionKind {
+	gvks := []schema.GroupVersionKind{t.GroupVersionKind()}
+	for _, version := range t.AltVersions {
+		gvks = append(gvks, schema.GroupVersionKind{Group: t.Group, Version: version, Kind: t.Kind})
+	}
+	return gvks
+}
+
+var defaultTrackedResources = []TrackedResource{
+	{
+		Group:       "networking.k8s.io",
+		Version:     "v1",
+		Kind:        "NetworkPolicy",
+		Resource:    "networkpolicies",
+		Namespaced:  true,
+		Dir:         "k8s-policies",
+		DisplayName: "K8s network policy",
+	},
+	{
+		Group:       "crd.antrea.io",
+		Version:     "v1alpha1",
+		Kind:        "NetworkPolicy",
+		Resource:    "networkpolicies",
+		Namespaced:  true,
+		Dir:         "antrea-policies",
+		DisplayName: "Antrea network policy",
+	},
+	{
+		Group:       "crd.antrea.io",
+		Version:     "v1alpha1",
+		Kind:        "ClusterNetworkPolicy",
+		Resource:    "clusternetworkpolicies",
+		Namespaced:  false,
+		Dir:         "antrea-cluster-policies",
+		DisplayName: "Antrea cluster network policy",
+	},
+	{
+		Group:       "crd.antrea.io",
+		Version:     "v1alpha1",
+		Kind:        "Tier",
+		Resource:    "tiers",
+		Namespaced:  false,
+		Dir:         "antrea-tiers",
+		DisplayName: "Antrea tier",
+	},
+	{
+		Group:       "crd.antrea.io",
+		Version:     "v1alpha3",
+		AltVersions: []string{"v1alpha2"},
+		Kind:        "ClusterGroup",
+		Resource:    "clustergroups",
+		Namespaced:  false,
+		Dir:         "antrea-cluster-groups",
+		DisplayName: "Antrea cluster group",
+	},
+	{
+		Group:       "crd.antrea.io",
+		Version:     "v1alpha3",
+		Kind:        "Group",
+		Resource:    "groups",
+		Namespaced:  true,
+		Dir:         "antrea-groups",
+		DisplayName: "Antrea group",
+	},
+	{
+		Group:       "crd.antrea.io",
+		Version:     "v1alpha2",
+		Kind:        "ExternalEntity",
+		Resource:    "externalentities",
+		Namespaced:  true,
+		Dir:         "antrea-external-entities",
+		DisplayName: "Antrea external entity",
+	},
+	{
+		Group:       "crd.antrea.io",
+		Version:     "v1alpha2",
+		Kind:        "Egress",
+		Resource:    "egresses",
+		Namespaced:  false,
+		Dir:         "antrea-egresses",
+		DisplayName: "Antrea egress",
+	},
+}
+
+// ResourceRegistry holds the set of resource kinds tracked in the repository and resolves
+// audit object references, stored objects and repository directories to them.
+type ResourceRegistry struct {
+	resources []TrackedResource
+}
+
+func NewResourceRegistry(resources []TrackedResource) (*ResourceRegistry, error) {
+	dirs := map[string]bool{}
+	groupResources := map[string]bool{}
+	for _, r := range resources {
+		if r.Version == "" || r.Kind == "" || r.Resource == "" || r.Dir == "" {
+			return nil, fmt.Errorf("tracked resource %+v must specify version, kind, resource and dir", r)
+		}
+		if dirs[r.Dir] {
+			return nil, fmt.Errorf("directory %s is used by more than one tracked resource", r.Dir)
+		}
+		dirs[r.Dir] = true
+		groupResource := schema.GroupResource{Group: r.Group, Resource: r.Resource}.String()
+		if groupResources[groupResource] {
+			return nil, fmt.Errorf("resource %s is tracked more than once", groupResource)
+		}
+		groupResources[groupResource] = true
+	}
+	registry := &ResourceRegistry{}
+	for _, r := range resources {
+		if r.DisplayName == "" {
+			r.DisplayName = r.Kind
+		}
+		registry.resources = append(registry.resources, r)
+	}
+	return registry, nil
+}
+
+func DefaultResourceRegistry() *ResourceRegistry {
+	registry, _ := NewResourceRegistry(defaultTrackedResources)
+	return registry
+}
+
+func (r *ResourceRegistry) Resources() []TrackedResource {
+	return r.resources
+}
+
+// ForObjectRef returns the tracked resource an audit event refers to.
+func (r *ResourceRegistry) ForObjectRef(ref *auditv1.ObjectReference) (TrackedResource, bool) {
+	if ref == nil {
+		return TrackedResource{}, false
+	}
+	for _, res := range r.resources {
+		if res.Group == ref.APIGroup && res.Resource == ref.Resource {
+			return res, true
+		}
+	}
+	return TrackedResource{}, false
+}
+
+// ForAPIVersionKind returns the tracked resource a stored or live object belongs to.
+func (r *ResourceRegistry) ForAPIVersionKind(apiVersion string, kind string) (TrackedResource, bool) {
+	gvk := schema.FromAPIVersionAndKind(apiVersion, kind)
+	for _, res := range r.resources {
+		for _, resGVK := range res.GroupVersionKinds() {
+			if resGVK == gvk {
+				return res, true
+			}
+		}
+	}
+	return TrackedResource{}, false
+}
+
+func (r *ResourceRegistry) ForDir(dir string) (TrackedResource, bool) {
+	for _, res := range r.resources {
+		if res.Dir == dir {
+			return res, true
+		}
+	}
+	return TrackedResource{}, false
+}
+
+func (r *ResourceRegistry) Dirs() []string {
+	var dirs []string
+	for _, res := range r.resources {
+		dirs = append(dirs, res.Dir)
+	}
+	return dirs
+}
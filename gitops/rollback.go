@@ -3,6 +3,7 @@ package gitops
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/ghodss/yaml"
 	"github.com/go-git/go-git/v5"
@@ -43,62 +44,100 @@ func (cr *CustomRepo) HashToCommit(commitSha string) (*object.Commit, error) {
 	return commit, nil
 }
 
+const (
+	rollbackUsername         = "audit-manager"
+	rollbackErrorTrailer     = "Rollback-Error"
+	compensationErrorTrailer = "Compensation-Error"
+)
+
+// RollbackRepo sets the cluster and the repository back to the state of the target commit.
+// The rollback runs as a transaction: if it fails, the cluster objects it already modified
+// are restored, the worktree is reset to the original HEAD and the failed attempt is recorded
+// as an empty commit.
 func (cr *CustomRepo) RollbackRepo(targetCommit *object.Commit) (string, error) {
+	if targetCommit == nil {
+		return "", ErrNoTargetCommit
+	}
 	cr.Mutex.Lock()
 	defer cr.Mutex.Unlock()
 
 	klog.V(2).InfoS("rollback initiated, ignoring all non-rollback generated audits",
 		"targetCommit", targetCommit.Hash.String())
 	cr.RollbackMode = true
+	defer func() {
+		cr.RollbackMode = false
+		if err := cr.replayJournal(); err != nil {
+			klog.ErrorS(err, "unable to replay audit events received during rollback")
+		}
+	}()
 
 	// Get patch between head and target commit
-	w, err := cr.Repo.Worktree()
+	headCommit, patch, err := cr.rollbackPatch(targetCommit)
 	if err != nil {
-		return "", fmt.Errorf("unable to get git worktree from repository: %w", err)
+		return "", err
 	}
-	h, err := cr.Repo.Head()
-	if err != nil {
-		return "", fmt.Errorf("unable to get repo head: %w", err)
-	}
-	headCommit, err := cr.Repo.CommitObject(h.Hash())
-	if err != nil {
-		return "", fmt.Errorf("unable to get head commit: %w", err)
+	txn := newRollbackTransaction(cr.K8s)
+	if err := cr.applyRollback(headCommit, targetCommit, patch, txn); err != nil {
+		return "", cr.abortRollback(headCommit, targetCommit, txn, err)
 	}
-	patch, err := headCommit.Patch(targetCommit)
+	klog.V(2).InfoS("rollback successful", "targetCommit", targetCommit.Hash.String())
+	return targetCommit.Hash.String(), nil
+}
+
+func (cr *CustomRepo) applyRollback(headCommit *object.Commit, targetCommit *object.Commit, patch *object.Patch, txn *rollbackTransaction) error {
+	w, err := cr.Repo.Worktree()
 	if err != nil {
-		return "", fmt.Errorf("unable to get patch between commits: %w", err)
+		return fmt.Errorf("unable to get git worktree from repository: %w", err)
 	}
 
 	// Must do cluster delete requests before resetting in order to be able to read metadata from files
-	if err := cr.doDeletePatch(patch); err != nil {
-		return "", fmt.Errorf("could not patch cluster to old commit state (delete phase): %w", err)
+	if err := cr.doDeletePatch(patch, txn); err != nil {
+		return fmt.Errorf("could not patch cluster to old commit state (delete phase): %w", err)
 	}
 
 	// Update repo using resets
 	err = resetWorktree(w, targetCommit.Hash, git.HardReset)
 	if err != nil {
-		return "", fmt.Errorf("unable to hard reset repo: %w", err)
+		return fmt.Errorf("unable to hard reset repo: %w", err)
 	}
-	err = resetWorktree(w, h.Hash(), git.SoftReset)
+	err = resetWorktree(w, headCommit.Hash, git.SoftReset)
 	if err != nil {
-		return "", fmt.Errorf("unable to hard reset repo: %w", err)
+		return fmt.Errorf("unable to hard reset repo: %w", err)
 	}
 
 	// Must similarly do cluster update/create requests after resetting
-	if err := cr.doCreateUpdatePatch(patch); err != nil {
-		return "", fmt.Errorf("could not patch cluster to old commit state (create/update phase): %w", err)
+	if err := cr.doCreateUpdatePatch(patch, txn); err != nil {
+		return fmt.Errorf("could not patch cluster to old commit state (create/update phase): %w", err)
 	}
 
 	// Finally commit changes to repo after cluster updates
-	username := "audit-manager"
-	email := "system@audit.antrea.io"
 	message := "Rollback to commit " + targetCommit.Hash.String()
-	if err := cr.AddAndCommit(username, email, message); err != nil {
-		return "", fmt.Errorf("error while committing rollback: %w", err)
+	if err := cr.commitEmpty(rollbackUsername, systemEmail, message, time.Now()); err != nil {
+		return fmt.Errorf("error while committing rollback: %w", err)
 	}
-	cr.RollbackMode = false
-	klog.V(2).InfoS("rollback successful", "targetCommit", targetCommit.Hash.String())
-	return targetCommit.Hash.String(), nil
+	return nil
+}
+
+// abortRollback undoes a failed rollback and records the attempt in the history. It returns
+// the error to report for the rollback.
+func (cr *CustomRepo) abortRollback(headCommit *object.Commit, targetCommit *object.Commit, txn *rollbackTransaction, cause error) error {
+	klog.ErrorS(cause, "rollback failed, restoring original state", "targetCommit", targetCommit.Hash.String())
+	trailers := [][2]string{{rollbackErrorTrailer, trailerValue(cause.Error())}}
+	err := cause
+	if compensationErr := txn.compensate(); compensationErr != nil {
+		klog.ErrorS(compensationErr, "unable to restore cluster resources modified by failed rollback")
+		trailers = append(trailers, [2]string{compensationErrorTrailer, trailerValue(compensationErr.Error())})
+		err = fmt.Errorf("%w (unable to restore cluster state: %v)", cause, compensationErr)
+	}
+	if resetErr := cr.restoreWorktree(headCommit.Hash); resetErr != nil {
+		klog.ErrorS(resetErr, "unable to restore worktree after failed rollback", "commit", headCommit.Hash.String())
+		return err
+	}
+	message := withTrailers("Failed rollback to commit "+targetCommit.Hash.String(), trailers)
+	if commitErr := cr.commitEmpty(rollbackUsername, systemEmail, message, time.Now()); commitErr != nil {
+		klog.ErrorS(commitErr, "unable to record failed rollback")
+	}
+	return err
 }
 
 func resetWorktree(w *git.Worktree, hash plumbing.Hash, mode git.ResetMode) error {
@@ -112,7 +151,7 @@ func resetWorktree(w *git.Worktree, hash plumbing.Hash, mode git.ResetMode) erro
 	return nil
 }
 
-func (cr *CustomRepo) doDeletePatch(patch *object.Patch) error {
+func (cr *CustomRepo) doDeletePatch(patch *object.Patch, txn *rollbackTransaction) error {
 	for _, filePatch := range patch.FilePatches() {
 		fromFile, toFile := filePatch.Files()
 		if toFile == nil {
@@ -121,7 +160,7 @@ func (cr *CustomRepo) doDeletePatch(patch *object.Patch) error {
 			if err != nil {
 				return fmt.Errorf("unable to read resource at path %s: %w", path, err)
 			}
-			if err := cr.K8s.DeleteResource(resource); err != nil {
+			if err := txn.apply(resource, func() error { return cr.K8s.DeleteResource(resource) }); err != nil {
 				return fmt.Errorf("unable to delete resource %s: %w", resource.GetName(), err)
 			}
 			klog.V(2).InfoS("(rollback) deleted file", "path", path)
@@ -130,7 +169,7 @@ func (cr *CustomRepo) doDeletePatch(patch *object.Patch) error {
 	return nil
 }
 
-func (cr *CustomRepo) doCreateUpdatePatch(patch *object.Patch) error {
+func (cr *CustomRepo) doCreateUpdatePatch(patch *object.Patch, txn *rollbackTransaction) error {
 	for _, filePatch := range patch.FilePatches() {
 		_, toFile := filePatch.Files()
 		if toFile != nil {
@@ -139,7 +178,10 @@ func (cr *CustomRepo) doCreateUpdatePatch(patch *object.Patch) error {
 			if err != nil {
 				return fmt.Errorf("unable to read resource at path %s: %w", path, err)
 			}
-			if err := cr.K8s.CreateOrUpdateResource(resource); err != nil {
+			if err := cr.restoreScrubbed(resource); err != nil {
+				return fmt.Errorf("unable to restore scrubbed fields of resource %s: %w", resource.GetName(), err)
+			}
+			if err := txn.apply(resource, func() error { return cr.K8s.CreateOrUpdateResource(resource) }); err != nil {
 				return fmt.Errorf("unable to create/update resource %s: %w", resource.GetName(), err)
 			}
 			klog.V(2).InfoS("(rollback) created/updated file", "path", path)
@@ -150,23 +192,15 @@ func (cr *CustomRepo) doCreateUpdatePatch(patch *object.Patch) error {
 
 func (cr *CustomRepo) getResourceByPath(path string) (*unstructured.Unstructured, error) {
 	resource := &unstructured.Unstructured{}
-	gvk := schema.GroupVersionKind{}
 	if err := cr.readResource(resource, path); err != nil {
 		return nil, fmt.Errorf("unable to read resource: %w", err)
 	}
 	apiVersion := resource.GetAPIVersion()
 	kind := resource.GetKind()
-	if apiVersion == "networking.k8s.io/v1" {
-		gvk.Group = "networking.k8s.io"
-		gvk.Version = "v1"
-	} else if apiVersion == "crd.antrea.io/v1alpha1" {
-		gvk.Group = "crd.antrea.io"
-		gvk.Version = "v1alpha1"
-	} else {
-		return nil, fmt.Errorf("unknown apiVersion found: %s", apiVersion)
-	}
-	gvk.Kind = kind
-	resource.SetGroupVersionKind(gvk)
+	if _, ok := cr.Registry.ForAPIVersionKind(apiVersion, kind); !ok {
+		return nil, fmt.Errorf("untracked resource found: apiVersion: %s, kind: %s", apiVersion, kind)
+	}
+	resource.SetGroupVersionKind(schema.FromAPIVersionAndKind(apiVersion, kind))
 	return resource, nil
 }
 
@@ -0,0 +1,143 @@
+package gitops
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ghodss/yaml"
+	"github.com/go-git/go-git/v5/plumbing/format/diff"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+type RollbackAction string
+
+const (
+	RollbackCreate RollbackAction = "Create"
+	RollbackUpdate RollbackAction = "Update"
+	RollbackDelete RollbackAction = "Delete"
+)
+
+// PlannedChange is a cluster mutation a rollback would make, with the unified diff of the
+// resource file between HEAD and the target commit.
+type PlannedChange struct {
+	Path      string         `json:"path"`
+	Action    RollbackAction `json:"action"`
+	Kind      string         `json:"kind,omitempty"`
+	Namespace string         `json:"namespace,omitempty"`
+	Name      string         `json:"name,omitempty"`
+	Diff      string         `json:"diff"`
+}
+
+// RollbackPlan lists the changes RollbackRepo would make to roll back from Head to Target.
+type RollbackPlan struct {
+	Head    string          `json:"head"`
+	Target  string          `json:"target"`
+	Changes []PlannedChange `json:"changes"`
+}
+
+// ErrNoTargetCommit is returned when a rollback is requested without a target commit.
+var ErrNoTargetCommit = errors.New("no rollback target commit")
+
+// PlanRollback computes the changes a rollback to the target commit would make, without
+// modifying the cluster or the repository.
+func (cr *CustomRepo) PlanRollback(targetCommit *object.Commit) (*RollbackPlan, error) {
+	if targetCommit == nil {
+		return nil, ErrNoTargetCommit
+	}
+	cr.Mutex.Lock()
+	defer cr.Mutex.Unlock()
+	headCommit, patch, err := cr.rollbackPatch(targetCommit)
+	if err != nil {
+		return nil, err
+	}
+	plan := &RollbackPlan{
+		Head:    headCommit.Hash.String(),
+		Target:  targetCommit.Hash.String(),
+		Changes: []PlannedChange{},
+	}
+	for _, filePatch := range patch.FilePatches() {
+		fromFile, toFile := filePatch.Files()
+		change := PlannedChange{Action: RollbackUpdate}
+		commit, path := targetCommit, ""
+		switch {
+		case toFile == nil:
+			change.Action = RollbackDelete
+			commit, path = headCommit, fromFile.Path()
+		case fromFile == nil:
+			change.Action = RollbackCreate
+			path = toFile.Path()
+		default:
+			path = toFile.Path()
+		}
+		change.Path = path
+		resource, err := commitResource(commit, path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read resource at path %s: %w", path, err)
+		}
+		change.Kind = resource.GetKind()
+		change.Namespace = resource.GetNamespace()
+		change.Name = resource.GetName()
+		var buf bytes.Buffer
+		if err := diff.NewUnifiedEncoder(&buf, diff.DefaultContextLines).Encode(singleFilePatch{filePatch}); err != nil {
+			return nil, fmt.Errorf("unable to compute diff for path %s: %w", path, err)
+		}
+		change.Diff = buf.String()
+		plan.Changes = append(plan.Changes, change)
+	}
+	return plan, nil
+}
+
+// rollbackPatch returns the HEAD commit and the patch from HEAD to the target commit. It must
+// be called with the repository mutex held.
+func (cr *CustomRepo) rollbackPatch(targetCommit *object.Commit) (*object.Commit, *object.Patch, error) {
+	h, err := cr.Repo.Head()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get repo head: %w", err)
+	}
+	headCommit, err := cr.Repo.CommitObject(h.Hash())
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get head commit: %w", err)
+	}
+	patch, err := headCommit.Patch(targetCommit)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get patch between commits: %w", err)
+	}
+	return headCommit, patch, nil
+}
+
+// commitResource reads the resource stored at path in a commit.
+func commitResource(commit *object.Commit, path string) (*unstructured.Unstructured, error) {
+	f, err := commit.File(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get file from commit %s: %w", commit.Hash.String(), err)
+	}
+	contents, err := f.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read file contents: %w", err)
+	}
+	j, err := yaml.YAMLToJSON([]byte(contents))
+	if err != nil {
+		return nil, fmt.Errorf("error converting from YAML to JSON: %w", err)
+	}
+	resource := &unstructured.Unstructured{}
+	if err := json.Unmarshal(j, &resource.Object); err != nil {
+		return nil, fmt.Errorf("error while unmarshalling from file: %w", err)
+	}
+	return resource, nil
+}
+
+// singleFilePatch allows encoding the diff of a single file of a patch.
+type singleFilePatch struct {
+	filePatch diff.FilePatch
+}
+
+func (p singleFilePatch) FilePatches() []diff.FilePatch {
+	return []diff.FilePatch{p.filePatch}
+}
+
+func (p singleFilePatch) Message() string {
+	return ""
+}
@@ -0,0 +1,86 @@
+package gitops
+
+import (
+	"fmt"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/klog/v2"
+)
+
+// rollbackTransaction records the state of the cluster objects a rollback modifies, so that
+// they can be restored if the rollback fails before being committed.
+type rollbackTransaction struct {
+	k8s     *K8sClient
+	touched []touchedResource
+	seen    map[string]bool
+}
+
+type touchedResource struct {
+	resource *unstructured.Unstructured
+	// original is the object before the rollback modified it, nil if it did not exist.
+	original *unstructured.Unstructured
+}
+
+func newRollbackTransaction(k8s *K8sClient) *rollbackTransaction {
+	return &rollbackTransaction{k8s: k8s, seen: map[string]bool{}}
+}
+
+// apply runs a change to a resource, saving the live state of the resource first so that it
+// can be restored. Only the first state of a resource is kept, and a change which fails is
+// not recorded.
+func (t *rollbackTransaction) apply(resource *unstructured.Unstructured, change func() error) error {
+	key := resource.GroupVersionKind().GroupKind().String() + "/" + resource.GetNamespace() + "/" + resource.GetName()
+	if t.seen[key] {
+		return change()
+	}
+	live := &unstructured.Unstructured{}
+	live.SetGroupVersionKind(resource.GroupVersionKind())
+	if _, err := t.k8s.GetResource(live, resource.GetNamespace(), resource.GetName()); apierrors.IsNotFound(err) {
+		live = nil
+	} else if err != nil {
+		return fmt.Errorf("unable to record state of resource %s: %w", resource.GetName(), err)
+	}
+	if err := change(); err != nil {
+		return err
+	}
+	t.seen[key] = true
+	t.touched = append(t.touched, touchedResource{resource: resource.DeepCopy(), original: live})
+	return nil
+}
+
+// compensate restores the recorded resources in reverse order: resources which did not exist
+// are deleted and the others are set back to their original state. It keeps going after a
+// failure and returns all the errors encountered.
+func (t *rollbackTransaction) compensate() error {
+	var errs []string
+	for i := len(t.touched) - 1; i >= 0; i-- {
+		touched := t.touched[i]
+		name := touched.resource.GetName()
+		if touched.original == nil {
+			err := t.k8s.DeleteResource(touched.resource.DeepCopy())
+			if err != nil && !apierrors.IsNotFound(err) {
+				errs = append(errs, fmt.Sprintf("unable to delete resource %s: %v", name, err))
+				continue
+			}
+			klog.V(2).InfoS("(rollback) removed resource created by failed rollback", "resource", name)
+			continue
+		}
+		original := touched.original.DeepCopy()
+		original.SetResourceVersion("")
+		original.SetUID("")
+		original.SetCreationTimestamp(metav1.Time{})
+		original.SetManagedFields(nil)
+		if err := t.k8s.CreateOrUpdateResource(original); err != nil {
+			errs = append(errs, fmt.Sprintf("unable to restore resource %s: %v", name, err))
+			continue
+		}
+		klog.V(2).InfoS("(rollback) restored resource modified by failed rollback", "resource", name)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
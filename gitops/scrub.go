@@ -0,0 +1,170 @@
+package gitops
+
+import (
+	"fmt"
+	"path"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+type ScrubAction string
+
+const (
+	ScrubActionDrop   ScrubAction = "Drop"
+	ScrubActionRedact ScrubAction = "Redact"
+
+	redactedValue = "REDACTED"
+)
+
+// ScrubRule removes or redacts annotations and labels of stored resources. Keys are matched
+// with path.Match patterns, e.g. "ci.example.com/*".
+type ScrubRule struct {
+	// Group and Kind restrict the rule to a resource kind, or to all the kinds of a group when
+	// Kind is empty; the rule applies to all tracked kinds when both are unset. A Kind must be
+	// qualified with its Group, written as "" for the core group.
+	Group       *string  `json:"group,omitempty"`
+	Kind        string   `json:"kind,omitempty"`
+	Annotations []string `json:"annotations,omitempty"`
+	Labels      []string `json:"labels,omitempty"`
+	// Action is Drop (the default) to remove matching keys, or Redact to keep the keys but
+	// replace their values.
+	Action ScrubAction `json:"action,omitempty"`
+}
+
+func (r ScrubRule) matchesKind(gk schema.GroupKind) bool {
+	if r.Group == nil {
+		return r.Kind == ""
+	}
+	return *r.Group == gk.Group && (r.Kind == "" || r.Kind == gk.Kind)
+}
+
+type scrubber struct {
+	rules []ScrubRule
+}
+
+func newScrubber(configRules []ScrubRule) (*scrubber, error) {
+	rules := append([]ScrubRule{}, configRules...)
+	for i, rule := range rules {
+		switch rule.Action {
+		case "":
+			rules[i].Action = ScrubActionDrop
+		case ScrubActionDrop, ScrubActionRedact:
+		default:
+			return nil, fmt.Errorf("scrub rule %d: unknown action %q", i, rule.Action)
+		}
+		if rule.Kind != "" && rule.Group == nil {
+			return nil, fmt.Errorf("scrub rule %d: kind %s must be qualified with a group, use \"\" for the core group", i, rule.Kind)
+		}
+		for _, pattern := range append(append([]string{}, rule.Annotations...), rule.Labels...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("scrub rule %d: invalid pattern %q: %w", i, pattern, err)
+			}
+		}
+	}
+	return &scrubber{rules: rules}, nil
+}
+
+// scrub applies the rules matching the kind of the resource to its annotations and labels.
+func (s *scrubber) scrub(resource *unstructured.Unstructured) {
+	gk := resource.GroupVersionKind().GroupKind()
+	for _, rule := range s.rules {
+		if !rule.matchesKind(gk) {
+			continue
+		}
+		resource.SetAnnotations(scrubKeys(resource.GetAnnotations(), rule.Annotations, rule.Action))
+		resource.SetLabels(scrubKeys(resource.GetLabels(), rule.Labels, rule.Action))
+	}
+}
+
+// restore replaces the scrubbed annotations and labels of a resource read from the repository
+// with the ones of the live object, so that a rollback neither applies redacted values nor
+// removes dropped keys. live is nil if the resource does not exist in the cluster.
+func (s *scrubber) restore(resource *unstructured.Unstructured, live *unstructured.Unstructured) {
+	gk := resource.GroupVersionKind().GroupKind()
+	var liveAnnotations, liveLabels map[string]string
+	if live != nil {
+		liveAnnotations, liveLabels = live.GetAnnotations(), live.GetLabels()
+	}
+	for _, rule := range s.rules {
+		if !rule.matchesKind(gk) {
+			continue
+		}
+		resource.SetAnnotations(restoreKeys(resource.GetAnnotations(), liveAnnotations, rule.Annotations))
+		resource.SetLabels(restoreKeys(resource.GetLabels(), liveLabels, rule.Labels))
+	}
+}
+
+func (s *scrubber) hasRules(gk schema.GroupKind) bool {
+	for _, rule := range s.rules {
+		if rule.matchesKind(gk) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchKey(key string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func scrubKeys(values map[string]string, patterns []string, action ScrubAction) map[string]string {
+	if len(values) == 0 || len(patterns) == 0 {
+		return values
+	}
+	for key := range values {
+		if !matchKey(key, patterns) {
+			continue
+		}
+		if action == ScrubActionRedact {
+			values[key] = redactedValue
+		} else {
+			delete(values, key)
+		}
+	}
+	return values
+}
+
+func restoreKeys(values map[string]string, live map[string]string, patterns []string) map[string]string {
+	if len(patterns) == 0 {
+		return values
+	}
+	restored := map[string]string{}
+	for key, value := range values {
+		if !matchKey(key, patterns) {
+			restored[key] = value
+		}
+	}
+	for key, value := range live {
+		if matchKey(key, patterns) {
+			restored[key] = value
+		}
+	}
+	if len(restored) == 0 {
+		return nil
+	}
+	return restored
+}
+
+// restoreScrubbed prepares a resource read from the repository for a rollback by restoring
+// the values removed by the scrub rules from the live object.
+func (cr *CustomRepo) restoreScrubbed(resource *unstructured.Unstructured) error {
+	if !cr.scrubber.hasRules(resource.GroupVersionKind().GroupKind()) {
+		return nil
+	}
+	live := &unstructured.Unstructured{}
+	live.SetGroupVersionKind(resource.GroupVersionKind())
+	if _, err := cr.K8s.GetResource(live, resource.GetNamespace(), resource.GetName()); apierrors.IsNotFound(err) {
+		live = nil
+	} else if err != nil {
+		return err
+	}
+	cr.scrubber.restore(resource, live)
+	return nil
+}
@@ -2,17 +2,41 @@ package gitops
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
-	"github.com/ghodss/yaml"
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/klog/v2"
 )
 
 func (cr *CustomRepo) AddAndCommit(username string, email string, message string) error {
+	return cr.addAndCommitAt(username, email, message, time.Now())
+}
+
+// addAndCommitAt commits the worktree with the given author date, e.g. the time at which an
+// audited change happened. The committer date is always the current time. Nothing is
+// committed if the worktree matches HEAD, e.g. when an update does not change the stored form
+// of a resource.
+func (cr *CustomRepo) addAndCommitAt(username string, email string, message string, when time.Time) error {
+	return cr.commitWorktree(username, email, message, when, false)
+}
+
+// commitEmpty commits the worktree even if it matches HEAD, for commits which record an event
+// rather than a change, e.g. the start of the history or a rollback.
+func (cr *CustomRepo) commitEmpty(username string, email string, message string, when time.Time) error {
+	return cr.commitWorktree(username, email, message, when, true)
+}
+
+func (cr *CustomRepo) commitWorktree(username string, email string, message string, when time.Time, allowEmpty bool) error {
 	w, err := cr.Repo.Worktree()
 	if err != nil {
 		return fmt.Errorf("unable to get git worktree from repository: %w", err)
@@ -21,8 +45,23 @@ func (cr *CustomRepo) AddAndCommit(username string, email string, message string
 	if err != nil {
 		return fmt.Errorf("unable to add git change to worktree: %w", err)
 	}
+	if !allowEmpty {
+		status, err := w.Status()
+		if err != nil {
+			return fmt.Errorf("unable to get worktree status: %w", err)
+		}
+		if status.IsClean() {
+			klog.V(2).InfoS("no changes to commit", "message", strings.SplitN(message, "\n", 2)[0])
+			return nil
+		}
+	}
 	_, err = w.Commit(message, &git.CommitOptions{
 		Author: &object.Signature{
+			Name:  username,
+			Email: email,
+			When:  when,
+		},
+		Committer: &object.Signature{
 			Name:  username,
 			Email: email,
 			When:  time.Now(),
@@ -34,17 +73,55 @@ func (cr *CustomRepo) AddAndCommit(username string, email string, message string
 	return nil
 }
 
-func (cr *CustomRepo) modifyFile(event auditv1.Event) error {
-	resource := unstructured.Unstructured{}
-	if err := json.Unmarshal(event.ResponseObject.Raw, &resource); err != nil {
-		return fmt.Errorf("unable to unmarshal ResponseObject resource config: %w", err)
+// restoreWorktree resets the branch, index and worktree to the given commit and removes any
+// untracked files left behind by partially applied changes.
+func (cr *CustomRepo) restoreWorktree(hash plumbing.Hash) error {
+	w, err := cr.Repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("unable to get git worktree from repository: %w", err)
+	}
+	if err := resetWorktree(w, hash, git.HardReset); err != nil {
+		return err
+	}
+	// without Dir, only the untracked files at the root of the worktree are removed
+	if err := w.Clean(&git.CleanOptions{Dir: true}); err != nil {
+		return fmt.Errorf("unable to clean worktree: %w", err)
+	}
+	return nil
+}
+
+// getEventObject returns the object produced by a create, update or patch event. When the
+// audit policy level does not record response bodies, the object is read from the cluster
+// instead and reconstructed is true: the committed state may then include later changes.
+func (cr *CustomRepo) getEventObject(event auditv1.Event, resource TrackedResource) (*unstructured.Unstructured, bool, error) {
+	obj := &unstructured.Unstructured{}
+	if event.ResponseObject != nil && len(event.ResponseObject.Raw) > 0 {
+		if err := json.Unmarshal(event.ResponseObject.Raw, obj); err != nil {
+			return nil, false, fmt.Errorf("%w: unable to unmarshal ResponseObject resource config: %v", ErrUnsupportedEvent, err)
+		}
+		return obj, false, nil
+	}
+	if event.ObjectRef.Name == "" {
+		return nil, false, fmt.Errorf("%w: audit event %s has neither a response object nor an object name", ErrUnsupportedEvent, event.AuditID)
 	}
-	clearFields(&resource)
-	y, err := yaml.Marshal(&resource)
+	gvk := resource.GroupVersionKind()
+	if event.ObjectRef.APIVersion != "" {
+		gvk.Version = event.ObjectRef.APIVersion
+	}
+	obj.SetGroupVersionKind(gvk)
+	if _, err := cr.K8s.GetResource(obj, event.ObjectRef.Namespace, event.ObjectRef.Name); err != nil {
+		return nil, false, err
+	}
+	klog.V(2).InfoS("audit event has no response object, resource read from cluster", "auditID", event.AuditID, "name", event.ObjectRef.Name)
+	return obj, true, nil
+}
+
+func (cr *CustomRepo) modifyFile(event auditv1.Event, resource *unstructured.Unstructured) error {
+	y, err := cr.marshalResource(resource)
 	if err != nil {
-		return fmt.Errorf("unable to marshal new resource config: %w", err)
+		return fmt.Errorf("%w: %v", ErrUnsupportedEvent, err)
 	}
-	path := getAbsRepoPath("", event)
+	path := cr.getAbsRepoPath("", event)
 	path += getFileName(event)
 	newfile, err := cr.Fs.Create(path)
 	if err != nil {
@@ -55,15 +132,137 @@ func (cr *CustomRepo) modifyFile(event auditv1.Event) error {
 	return nil
 }
 
+// errNotInRepository is returned by deleteFile when the deleted resource has no file in the
+// repository, e.g. because it was created before tracking started.
+var errNotInRepository = errors.New("resource is not in the repository")
+
 func (cr *CustomRepo) deleteFile(event auditv1.Event) error {
 	w, err := cr.Repo.Worktree()
 	if err != nil {
 		return fmt.Errorf("unable to get git worktree from repository: %w", err)
 	}
-	path := getRelRepoPath(event) + getFileName(event)
+	path := cr.getRelRepoPath(event) + getFileName(event)
+	if _, err := cr.Fs.Stat(path); os.IsNotExist(err) {
+		return errNotInRepository
+	}
 	_, err = w.Remove(path)
 	if err != nil {
 		return fmt.Errorf("unable to remove file at: %s: %w", path, err)
 	}
 	return nil
 }
+
+func (cr *CustomRepo) deleteCollection(event auditv1.Event) (int, error) {
+	paths, err := cr.getCollectionPaths(event)
+	if err != nil {
+		return 0, err
+	}
+	return cr.removePaths(paths, objectVersion{Timestamp: event.StageTimestamp.Time})
+}
+
+// removePaths removes the files of resources deleted at the given version, except the ones
+// which are not in the repository or were modified after the delete. It returns the number of
+// files removed.
+func (cr *CustomRepo) removePaths(paths []string, version objectVersion) (int, error) {
+	w, err := cr.Repo.Worktree()
+	if err != nil {
+		return 0, fmt.Errorf("unable to get git worktree from repository: %w", err)
+	}
+	removed := 0
+	for _, path := range paths {
+		if _, err := cr.Fs.Stat(path); os.IsNotExist(err) {
+			klog.V(2).InfoS("deleted resource is not in the repository, skipping", "path", path)
+			continue
+		}
+		if cr.versions.isStale(path, version) {
+			klog.InfoS("deleted resource was modified after the delete, skipping", "path", path)
+			continue
+		}
+		if _, err := w.Remove(path); err != nil {
+			return removed, fmt.Errorf("unable to remove file at: %s: %w", path, err)
+		}
+		cr.versions.setDeleted(path, version)
+		removed++
+	}
+	return removed, nil
+}
+
+// getCollectionPaths returns the repo paths of the resources removed by a deletecollection
+// event. The response object lists the deleted items when the audit level allows it; without
+// it every file under the affected directory is removed, unless the request used a selector,
+// in which case only the files of resources which are no longer in the cluster are removed.
+func (cr *CustomRepo) getCollectionPaths(event auditv1.Event) ([]string, error) {
+	dir := cr.getRelRepoPath(event)
+	resource, _ := cr.Registry.ForObjectRef(event.ObjectRef)
+	if event.ResponseObject != nil && len(event.ResponseObject.Raw) > 0 {
+		list := unstructured.UnstructuredList{}
+		if err := json.Unmarshal(event.ResponseObject.Raw, &list); err == nil && strings.HasSuffix(list.GetKind(), "List") {
+			var paths []string
+			for _, item := range list.Items {
+				paths = append(paths, computePath("", resource.Dir, item.GetNamespace(), item.GetName()+".yaml"))
+			}
+			return paths, nil
+		}
+	}
+	if uri, err := url.Parse(event.RequestURI); err == nil {
+		query := uri.Query()
+		if query.Get("labelSelector") != "" || query.Get("fieldSelector") != "" {
+			paths, err := cr.listMissingResourceFiles(resource, dir)
+			if err != nil {
+				return nil, fmt.Errorf("unable to determine resources deleted by selector: %w", err)
+			}
+			return paths, nil
+		}
+	}
+	return cr.listResourceFiles(dir)
+}
+
+// listMissingResourceFiles lists the resource files under dir whose resources are not in the
+// cluster.
+func (cr *CustomRepo) listMissingResourceFiles(resource TrackedResource, dir string) ([]string, error) {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(resource.ListGroupVersionKind())
+	resources, err := cr.K8s.ListResource(list)
+	if err != nil {
+		return nil, err
+	}
+	live := map[string]bool{}
+	for _, item := range resources.Items {
+		live[computePath("", resource.Dir, item.GetNamespace(), item.GetName()+".yaml")] = true
+	}
+	paths, err := cr.listResourceFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, path := range paths {
+		if !live[path] {
+			missing = append(missing, path)
+		}
+	}
+	return missing, nil
+}
+
+// listResourceFiles recursively lists all resource files under dir in the worktree.
+func (cr *CustomRepo) listResourceFiles(dir string) ([]string, error) {
+	files, err := cr.Fs.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read directory %s: %w", dir, err)
+	}
+	var paths []string
+	for _, f := range files {
+		path := filepath.Join(dir, f.Name())
+		if f.IsDir() {
+			subPaths, err := cr.listResourceFiles(path)
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, subPaths...)
+		} else if filepath.Ext(f.Name()) == ".yaml" {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
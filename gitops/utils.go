@@ -1,42 +1,31 @@
 package gitops
 
 import (
+	"encoding/json"
+	"fmt"
 	"path/filepath"
 
+	billy "github.com/go-git/go-billy/v5"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-var dirMap = map[string]string{
-	"networkpoliciesnetworking.k8s.io":    "k8s-policies",
-	"networkpoliciescrd.antrea.io":        "antrea-policies",
-	"clusternetworkpoliciescrd.antrea.io": "antrea-cluster-policies",
-	"tierscrd.antrea.io":                  "antrea-tiers",
-}
-
-var resourceMap = map[string]string{
-	"networkpoliciesnetworking.k8s.io":    "K8s network policy ",
-	"networkpoliciescrd.antrea.io":        "Antrea network policy ",
-	"clusternetworkpoliciescrd.antrea.io": "Antrea cluster network policy ",
-	"tierscrd.antrea.io":                  "Antrea tier ",
-}
-
 func computePath(dir string, resource string, namespace string, file string) string {
 	return filepath.Join(dir, resource, namespace, file)
 }
 
-func getAbsRepoPath(dir string, event auditv1.Event) string {
-	resource := dirMap[event.ObjectRef.Resource+event.ObjectRef.APIGroup]
+func (cr *CustomRepo) getAbsRepoPath(dir string, event auditv1.Event) string {
+	resource, _ := cr.Registry.ForObjectRef(event.ObjectRef)
 	namespace := event.ObjectRef.Namespace
-	return computePath(dir, resource, namespace, "")
+	return computePath(dir, resource.Dir, namespace, "")
 }
 
-func getRelRepoPath(event auditv1.Event) string {
-	resource := dirMap[event.ObjectRef.Resource+event.ObjectRef.APIGroup]
+func (cr *CustomRepo) getRelRepoPath(event auditv1.Event) string {
+	resource, _ := cr.Registry.ForObjectRef(event.ObjectRef)
 	namespace := event.ObjectRef.Namespace
-	path := computePath("", resource, namespace, "")
+	path := computePath("", resource.Dir, namespace, "")
 	return path
 }
 
@@ -44,6 +33,25 @@ func getFileName(event auditv1.Event) string {
 	return "/" + event.ObjectRef.Name + ".yaml"
 }
 
+// withObjectName fills in the name of the object of an event when the request did not
+// include it, i.e. for objects created with generateName, using the response object.
+func withObjectName(event auditv1.Event) auditv1.Event {
+	if event.ObjectRef == nil || event.ObjectRef.Name != "" || event.ResponseObject == nil {
+		return event
+	}
+	obj := metav1.PartialObjectMetadata{}
+	if err := json.Unmarshal(event.ResponseObject.Raw, &obj); err != nil || obj.Name == "" {
+		return event
+	}
+	objectRef := *event.ObjectRef
+	objectRef.Name = obj.Name
+	if objectRef.Namespace == "" {
+		objectRef.Namespace = obj.Namespace
+	}
+	event.ObjectRef = &objectRef
+	return event
+}
+
 func clearFields(resource *unstructured.Unstructured) {
 	resource.SetUID("")
 	resource.SetGeneration(0)
@@ -64,3 +72,24 @@ func stringInSlice(a string, list []string) bool {
 	}
 	return false
 }
+
+// writeFileAtomic replaces the content of a file by writing to a temporary file and renaming it,
+// so that a crash never leaves a partially written file behind.
+func writeFileAtomic(fs billy.Filesystem, name string, data []byte) error {
+	tmpFile := name + ".tmp"
+	f, err := fs.Create(tmpFile)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %w", tmpFile, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write %s: %w", tmpFile, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unable to write %s: %w", tmpFile, err)
+	}
+	if err := fs.Rename(tmpFile, name); err != nil {
+		return fmt.Errorf("unable to rename %s: %w", tmpFile, err)
+	}
+	return nil
+}
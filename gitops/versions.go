@@ -0,0 +1,152 @@
+package gitops
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	billy "github.com/go-git/go-billy/v5"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+const (
+	versionIndexFile       = "resource-versions.json"
+	resourceVersionTrailer = "Resource-Version"
+	// maxDeletedVersions bounds the number of versions kept for removed files, which only
+	// guard against audit events received late for deleted resources.
+	maxDeletedVersions = 1000
+)
+
+// objectVersion identifies the object state a repository file was produced from.
+type objectVersion struct {
+	ResourceVersion string    `json:"resourceVersion,omitempty"`
+	Timestamp       time.Time `json:"timestamp,omitempty"`
+	// Deleted is set when the object state is a deletion, i.e. the file was removed.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// isOlderThan reports whether v describes an older object state than other. Resource versions
+// are opaque, but the ones of the apiserver are integers which are compared when both parse;
+// stage timestamps are compared otherwise. If neither can be compared the state is not
+// considered older.
+func (v objectVersion) isOlderThan(other objectVersion) bool {
+	if v.ResourceVersion != "" && v.ResourceVersion == other.ResourceVersion {
+		return false
+	}
+	rv, err := strconv.ParseUint(v.ResourceVersion, 10, 64)
+	otherRV, otherErr := strconv.ParseUint(other.ResourceVersion, 10, 64)
+	if err == nil && otherErr == nil {
+		return rv < otherRV
+	}
+	if !v.Timestamp.IsZero() && !other.Timestamp.IsZero() {
+		return v.Timestamp.Before(other.Timestamp)
+	}
+	return false
+}
+
+func getEventVersion(event auditv1.Event) objectVersion {
+	version := objectVersion{Timestamp: event.StageTimestamp.Time}
+	if event.ResponseObject != nil && len(event.ResponseObject.Raw) > 0 {
+		obj := struct {
+			Metadata struct {
+				ResourceVersion string `json:"resourceVersion"`
+			} `json:"metadata"`
+		}{}
+		if err := json.Unmarshal(event.ResponseObject.Raw, &obj); err == nil {
+			version.ResourceVersion = obj.Metadata.ResourceVersion
+		}
+	}
+	return version
+}
+
+// versionIndex records, for every repository path, the version of the last object state
+// written to (or deleted from) it, so that late audit events cannot overwrite newer state.
+type versionIndex struct {
+	fs       billy.Filesystem
+	versions map[string]objectVersion
+}
+
+func newVersionIndex(fs billy.Filesystem) *versionIndex {
+	return &versionIndex{
+		fs:       fs,
+		versions: map[string]objectVersion{},
+	}
+}
+
+func (idx *versionIndex) get(path string) (objectVersion, bool) {
+	v, ok := idx.versions[path]
+	return v, ok
+}
+
+func (idx *versionIndex) set(path string, version objectVersion) {
+	idx.versions[path] = version
+}
+
+// setDeleted records the deletion of the resource of a path. Only the most recent
+// maxDeletedVersions deletions are kept.
+func (idx *versionIndex) setDeleted(path string, version objectVersion) {
+	version.Deleted = true
+	idx.versions[path] = version
+	var deleted []string
+	for p, v := range idx.versions {
+		if v.Deleted {
+			deleted = append(deleted, p)
+		}
+	}
+	if len(deleted) <= maxDeletedVersions {
+		return
+	}
+	sort.Slice(deleted, func(i, j int) bool {
+		return idx.versions[deleted[i]].Timestamp.Before(idx.versions[deleted[j]].Timestamp)
+	})
+	for _, p := range deleted[:len(deleted)-maxDeletedVersions] {
+		delete(idx.versions, p)
+	}
+}
+
+// isStale returns true if the path already holds a newer state than version.
+func (idx *versionIndex) isStale(path string, version objectVersion) bool {
+	current, ok := idx.versions[path]
+	return ok && version.isOlderThan(current)
+}
+
+func (idx *versionIndex) clone() *versionIndex {
+	c := newVersionIndex(idx.fs)
+	for path, v := range idx.versions {
+		c.versions[path] = v
+	}
+	return c
+}
+
+func (idx *versionIndex) load() error {
+	f, err := idx.fs.Open(versionIndexFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to open resource version index: %w", err)
+	}
+	defer f.Close()
+	j, err := ioutil.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("unable to read resource version index: %w", err)
+	}
+	if err := json.Unmarshal(j, &idx.versions); err != nil {
+		return fmt.Errorf("unable to unmarshal resource version index: %w", err)
+	}
+	return nil
+}
+
+func (idx *versionIndex) save() error {
+	j, err := json.Marshal(idx.versions)
+	if err != nil {
+		return fmt.Errorf("unable to marshal resource version index: %w", err)
+	}
+	if err := writeFileAtomic(idx.fs, versionIndexFile, j); err != nil {
+		return fmt.Errorf("unable to save resource version index: %w", err)
+	}
+	return nil
+}
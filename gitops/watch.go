@@ -0,0 +1,306 @@
+package gitops
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	authnv1 "k8s.io/api/authentication/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// watchUnknownUser is the author of changes which cannot be attributed to a field manager,
+	// e.g. deletions.
+	watchUnknownUser   = "unknown"
+	watchRetryInterval = 5 * time.Second
+)
+
+// WatchSource records changes to the tracked resources by watching them, for clusters where
+// the apiserver audit backends cannot be configured. Changes are converted to audit events
+// and go through the same pipeline as events received by the webhook. Watches do not identify
+// the user who made a change, so commits are attributed to the field manager which last wrote
+// the object.
+type WatchSource struct {
+	cr     *CustomRepo
+	client client.WithWatch
+}
+
+func NewWatchSource(cr *CustomRepo) (*WatchSource, error) {
+	c, ok := cr.K8s.Client.(client.WithWatch)
+	if !ok {
+		return nil, fmt.Errorf("kube client does not support watches")
+	}
+	return &WatchSource{cr: cr, client: c}, nil
+}
+
+// Run watches all tracked resource kinds until stopCh is closed. Each watch starts by listing
+// the resources and recording the changes missed while not watching.
+func (s *WatchSource) Run(stopCh <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+	var wg sync.WaitGroup
+	for _, resource := range s.cr.Registry.Resources() {
+		wg.Add(1)
+		go func(resource TrackedResource) {
+			defer wg.Done()
+			s.watchResource(ctx, resource)
+		}(resource)
+	}
+	wg.Wait()
+}
+
+func (s *WatchSource) watchResource(ctx context.Context, resource TrackedResource) {
+	for {
+		resourceVersion, err := s.sync(ctx, resource)
+		if err == nil {
+			err = s.watch(ctx, resource, resourceVersion)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			klog.V(2).InfoS("watch closed, restarting", "kind", resource.Kind)
+			continue
+		}
+		if isResourceNotServed(err) {
+			klog.V(2).InfoS("resource type is not served by the cluster, retrying later", "kind", resource.Kind)
+		} else {
+			klog.ErrorS(err, "unable to watch tracked resources, retrying", "kind", resource.Kind)
+		}
+		select {
+		case <-time.After(watchRetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sync records the differences between the listed resources and the repository, and returns
+// the resource version to start watching from.
+func (s *WatchSource) sync(ctx context.Context, resource TrackedResource) (string, error) {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(resource.ListGroupVersionKind())
+	if err := s.client.List(ctx, list); err != nil {
+		return "", fmt.Errorf("could not list resource APIVersion: %s Kind: %s: %w", list.GetAPIVersion(), list.GetKind(), err)
+	}
+	events, err := s.syncEvents(resource, list)
+	if err != nil {
+		return "", err
+	}
+	if len(events) > 0 {
+		klog.InfoS("recording changes missed while not watching", "kind", resource.Kind, "count", len(events))
+		if err := s.cr.HandleEvents(events); err != nil {
+			return "", fmt.Errorf("unable to record listed resources: %w", err)
+		}
+	}
+	return list.GetResourceVersion(), nil
+}
+
+func (s *WatchSource) syncEvents(resource TrackedResource, list *unstructured.UnstructuredList) ([]auditv1.Event, error) {
+	s.cr.Mutex.Lock()
+	defer s.cr.Mutex.Unlock()
+	existing, err := s.cr.listResourceFiles(resource.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var events []auditv1.Event
+	live := map[string]bool{}
+	for i := range list.Items {
+		obj := &list.Items[i]
+		path := computePath("", resource.Dir, obj.GetNamespace(), obj.GetName()+".yaml")
+		live[path] = true
+		verb := "update"
+		if !stringInSlice(path, existing) {
+			verb = "create"
+		}
+		if s.cr.isRecorded(path, verb, obj) {
+			continue
+		}
+		event, err := newWatchEvent(resource, verb, obj)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	for _, path := range existing {
+		if live[path] {
+			continue
+		}
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(resource.GroupVersionKind())
+		name := strings.TrimSuffix(strings.TrimPrefix(path, resource.Dir+string(filepath.Separator)), ".yaml")
+		if resource.Namespaced {
+			obj.SetNamespace(filepath.Dir(name))
+		}
+		obj.SetName(filepath.Base(name))
+		obj.SetResourceVersion(list.GetResourceVersion())
+		event, err := newWatchEvent(resource, "delete", obj)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func (s *WatchSource) watch(ctx context.Context, resource TrackedResource, resourceVersion string) error {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(resource.ListGroupVersionKind())
+	w, err := s.client.Watch(ctx, list, &client.ListOptions{Raw: &metav1.ListOptions{ResourceVersion: resourceVersion}})
+	if err != nil {
+		return fmt.Errorf("could not watch resource APIVersion: %s Kind: %s: %w", list.GetAPIVersion(), list.GetKind(), err)
+	}
+	defer w.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e, ok := <-w.ResultChan():
+			if !ok {
+				return nil
+			}
+			if e.Type == watch.Error {
+				return apierrors.FromObject(e.Object)
+			}
+			// the change would be lost if the watch went on, so the resources are listed again
+			if err := s.handleWatchEvent(resource, e); err != nil {
+				return fmt.Errorf("unable to record watched change: %w", err)
+			}
+		}
+	}
+}
+
+func (s *WatchSource) handleWatchEvent(resource TrackedResource, e watch.Event) error {
+	var verb string
+	switch e.Type {
+	case watch.Added:
+		verb = "create"
+	case watch.Modified:
+		verb = "update"
+	case watch.Deleted:
+		verb = "delete"
+	default:
+		return nil
+	}
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(e.Object)
+	if err != nil {
+		return fmt.Errorf("unable to convert watched object: %w", err)
+	}
+	obj := &unstructured.Unstructured{Object: u}
+	obj.SetGroupVersionKind(resource.GroupVersionKind())
+	path := computePath("", resource.Dir, obj.GetNamespace(), obj.GetName()+".yaml")
+	s.cr.Mutex.Lock()
+	recorded := s.cr.isRecorded(path, verb, obj)
+	s.cr.Mutex.Unlock()
+	if recorded {
+		klog.V(2).InfoS("watched change already recorded", "path", path, "resourceVersion", obj.GetResourceVersion())
+		return nil
+	}
+	event, err := newWatchEvent(resource, verb, obj)
+	if err != nil {
+		return err
+	}
+	return s.cr.HandleEvents([]auditv1.Event{event})
+}
+
+// isRecorded returns true if the repository already holds the given state of an object, e.g.
+// because it was written by a rollback or received as an audit event. It must be called with
+// the repository mutex held.
+func (cr *CustomRepo) isRecorded(path string, verb string, obj *unstructured.Unstructured) bool {
+	f, err := cr.Fs.Open(path)
+	if os.IsNotExist(err) {
+		return verb == "delete"
+	} else if err != nil || verb == "delete" {
+		return false
+	}
+	defer f.Close()
+	if current, ok := cr.versions.get(path); ok && current.ResourceVersion == obj.GetResourceVersion() {
+		return true
+	}
+	contents, err := ioutil.ReadAll(f)
+	if err != nil {
+		return false
+	}
+	y, err := cr.marshalResource(obj.DeepCopy())
+	return err == nil && string(y) == string(contents)
+}
+
+// newWatchEvent returns the audit event recording a watched change. The audit ID is derived
+// from the object UID and resource version, so that a change seen again after a restart is
+// not committed twice. The event time is the time of the last write of the field manager when
+// known, so that commits are dated like the ones of audit events.
+func newWatchEvent(resource TrackedResource, verb string, obj *unstructured.Unstructured) (auditv1.Event, error) {
+	raw, err := json.Marshal(obj.Object)
+	if err != nil {
+		return auditv1.Event{}, fmt.Errorf("unable to marshal watched object: %w", err)
+	}
+	user := watchUnknownUser
+	when := time.Now()
+	if verb != "delete" {
+		if manager, managerTime := lastManager(obj); manager != "" {
+			user = manager
+			if !managerTime.IsZero() {
+				when = managerTime
+			}
+		}
+	} else if deleted := obj.GetDeletionTimestamp(); deleted != nil {
+		when = deleted.Time
+	}
+	id := obj.GetUID()
+	if id == "" {
+		id = types.UID(computePath("", resource.Dir, obj.GetNamespace(), obj.GetName()))
+	}
+	eventTime := metav1.NewMicroTime(when)
+	return auditv1.Event{
+		AuditID: types.UID(fmt.Sprintf("watch:%s:%s:%s", id, obj.GetResourceVersion(), verb)),
+		Stage:   auditv1.StageResponseComplete,
+		Verb:    verb,
+		User:    authnv1.UserInfo{Username: user},
+		ObjectRef: &auditv1.ObjectReference{
+			Resource:   resource.Resource,
+			Namespace:  obj.GetNamespace(),
+			Name:       obj.GetName(),
+			APIGroup:   resource.Group,
+			APIVersion: obj.GroupVersionKind().Version,
+		},
+		ResponseObject:           &runtime.Unknown{Raw: raw, ContentType: runtime.ContentTypeJSON},
+		RequestReceivedTimestamp: eventTime,
+		StageTimestamp:           eventTime,
+	}, nil
+}
+
+// lastManager returns the name of the field manager which most recently wrote the object, and
+// the time of that write.
+func lastManager(obj *unstructured.Unstructured) (string, time.Time) {
+	manager := ""
+	var latest time.Time
+	for _, entry := range obj.GetManagedFields() {
+		var t time.Time
+		if entry.Time != nil {
+			t = entry.Time.Time
+		}
+		if manager == "" || !t.Before(latest) {
+			manager, latest = entry.Manager, t
+		}
+	}
+	return manager, latest
+}
@@ -0,0 +1,181 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"antrea-audit/auditlog"
+	"antrea-audit/gitops"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/stretchr/testify/assert"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+func readEventLines(t *testing.T, path string) [][]byte {
+	jsonstring, err := ioutil.ReadFile(path)
+	assert.NoError(t, err, "unable to read mock audit log")
+	jsonstring = bytes.TrimPrefix(jsonstring, []byte("\xef\xbb\xbf"))
+	eventList := auditv1.EventList{}
+	assert.NoError(t, json.Unmarshal(jsonstring, &eventList), "unable to unmarshal mock audit log")
+	var lines [][]byte
+	for _, event := range eventList.Items {
+		line, err := json.Marshal(event)
+		assert.NoError(t, err, "unable to marshal audit event")
+		lines = append(lines, append(line, '\n'))
+	}
+	return lines
+}
+
+func appendToFile(t *testing.T, path string, data []byte) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	assert.NoError(t, err, "unable to open audit log file")
+	_, err = f.Write(data)
+	assert.NoError(t, err, "unable to write audit log file")
+	assert.NoError(t, f.Close())
+}
+
+func countCommits(t *testing.T, cr *gitops.CustomRepo) int {
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	cIter, err := cr.Repo.Log(&git.LogOptions{From: h.Hash()})
+	assert.NoError(t, err, "unable to get repo log")
+	count := 0
+	for _, err := cIter.Next(); err == nil; _, err = cIter.Next() {
+		count++
+	}
+	return count
+}
+
+func TestTailAuditLog(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "audit-log")
+	assert.NoError(t, err, "unable to create temp dir")
+	defer os.RemoveAll(tmpDir)
+	logPath := filepath.Join(tmpDir, "audit.log")
+	checkpointPath := filepath.Join(tmpDir, "checkpoint.json")
+	fakeClient := NewClient(np1.DeepCopy(), anp1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	lines := readEventLines(t, "./files/rollback-log.txt")
+	// use an update of npA which changes its stored form
+	lines[1] = readEventLines(t, "./files/label-update-audit-log.txt")[0]
+
+	tailer, err := auditlog.NewTailer(logPath, checkpointPath, cr)
+	assert.NoError(t, err, "could not create audit log tailer")
+	// the audit log file may not exist yet
+	assert.NoError(t, tailer.Poll())
+	assert.Equal(t, 1, countCommits(t, cr))
+
+	// incomplete lines are only ingested once fully written
+	appendToFile(t, logPath, lines[0])
+	appendToFile(t, logPath, lines[1][:20])
+	assert.NoError(t, tailer.Poll())
+	assert.Equal(t, 2, countCommits(t, cr))
+	appendToFile(t, logPath, lines[1][20:])
+	assert.NoError(t, tailer.Poll())
+	assert.Equal(t, 3, countCommits(t, cr))
+	tailer.Close()
+
+	// the end of a file rotated while the tailer was stopped is ingested on restart
+	appendToFile(t, logPath, lines[2])
+	assert.NoError(t, os.Rename(logPath, logPath+".1"))
+	otherLines := readEventLines(t, "./files/correct-audit-log.txt")
+	appendToFile(t, logPath, otherLines[0])
+	tailer, err = auditlog.NewTailer(logPath, checkpointPath, cr)
+	assert.NoError(t, err, "could not recreate audit log tailer")
+	assert.NoError(t, tailer.Poll())
+	assert.Equal(t, 5, countCommits(t, cr))
+
+	// rotation while running
+	assert.NoError(t, os.Rename(logPath, logPath+".2"))
+	appendToFile(t, logPath+".2", otherLines[1])
+	appendToFile(t, logPath, lines[0])
+	assert.NoError(t, tailer.Poll())
+	// the already recorded event is skipped
+	assert.Equal(t, 6, countCommits(t, cr))
+	tailer.Close()
+
+	// the checkpoint prevents reprocessing the file after a restart
+	cr, err = gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	tailer, err = auditlog.NewTailer(logPath, checkpointPath, cr)
+	assert.NoError(t, err, "could not recreate audit log tailer")
+	assert.NoError(t, tailer.Poll())
+	assert.Equal(t, 1, countCommits(t, cr))
+	appendToFile(t, logPath, lines[1])
+	assert.NoError(t, tailer.Poll())
+	assert.Equal(t, 2, countCommits(t, cr))
+	tailer.Close()
+}
+
+func TestTailAuditLogRetriesFailedEvents(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "audit-log")
+	assert.NoError(t, err, "unable to create temp dir")
+	defer os.RemoveAll(tmpDir)
+	logPath := filepath.Join(tmpDir, "audit.log")
+	checkpointPath := filepath.Join(tmpDir, "checkpoint.json")
+	fakeClient := NewClient(np1.DeepCopy(), anp1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	// the resources deleted by the selector cannot be listed
+	k8s.Client = &unservedGroupClient{Client: fakeClient, group: "networking.k8s.io"}
+	for _, line := range readEventLines(t, "./files/selector-collection-audit-log.txt") {
+		appendToFile(t, logPath, line)
+	}
+
+	tailer, err := auditlog.NewTailer(logPath, checkpointPath, cr)
+	assert.NoError(t, err, "could not create audit log tailer")
+	assert.Error(t, tailer.Poll(), "events which cannot be applied should be reported")
+	assert.Equal(t, 1, countCommits(t, cr))
+	// the events are read again by the next poll, and after a restart
+	assert.Error(t, tailer.Poll(), "events which cannot be applied should be read again")
+	tailer.Close()
+	tailer, err = auditlog.NewTailer(logPath, checkpointPath, cr)
+	assert.NoError(t, err, "could not recreate audit log tailer")
+	defer tailer.Close()
+	assert.Error(t, tailer.Poll(), "events which cannot be applied should be read again after a restart")
+	assert.Equal(t, 1, countCommits(t, cr))
+}
+
+func TestTailAuditLogSkipsUnsupportedEvents(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "audit-log")
+	assert.NoError(t, err, "unable to create temp dir")
+	defer os.RemoveAll(tmpDir)
+	logPath := filepath.Join(tmpDir, "audit.log")
+	checkpointPath := filepath.Join(tmpDir, "checkpoint.json")
+	fakeClient := NewClient(np1.DeepCopy(), anp1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	// a get request, then the create of npC and a patch of npA whose response object cannot
+	// be read
+	appendToFile(t, logPath, readEventLines(t, "./files/read-audit-log.txt")[0])
+	for _, line := range readEventLines(t, "./files/partial-failure-audit-log.txt") {
+		appendToFile(t, logPath, line)
+	}
+
+	tailer, err := auditlog.NewTailer(logPath, checkpointPath, cr)
+	assert.NoError(t, err, "could not create audit log tailer")
+	defer tailer.Close()
+	assert.NoError(t, tailer.Poll(), "events which can never be applied should be skipped")
+	assert.Equal(t, 2, countCommits(t, cr))
+	_, err = cr.Fs.Stat("k8s-policies/nsA/npC.yaml")
+	assert.NoError(t, err, "events which can be applied should be committed")
+
+	// the checkpoint is moved past the skipped events
+	appendToFile(t, logPath, readEventLines(t, "./files/label-update-audit-log.txt")[0])
+	assert.NoError(t, tailer.Poll())
+	assert.Equal(t, 3, countCommits(t, cr))
+}
@@ -0,0 +1,48 @@
+package test
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"antrea-audit/gitops"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleCascadeDeletes(t *testing.T) {
+	fakeClient := NewClient(Np1.inputResource, Np2.inputResource, Np3.inputResource, Anp1.inputResource, Acnp1.inputResource)
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "unable to set up repo")
+	jsonStr, err := ioutil.ReadFile("./files/cascade-audit-log.txt")
+	assert.NoError(t, err, "could not read cascade-audit-log file")
+	err = cr.HandleEventList(jsonStr)
+	assert.NoError(t, err, "could not process audit events from file")
+
+	for _, path := range []string{"k8s-policies/nsA/npA.yaml", "k8s-policies/nsA/npB.yaml", "antrea-policies/nsA/anpA.yaml", "antrea-cluster-policies/cnpA.yaml"} {
+		_, err = cr.Fs.Stat(path)
+		assert.Error(t, err, "resource %s should have been removed", path)
+	}
+	_, err = cr.Fs.Stat("k8s-policies/nsB/npC.yaml")
+	assert.NoError(t, err, "resources of other namespaces should be kept")
+
+	author, resource, namespace, name := "", "", "", ""
+	since, until := time.Time{}, time.Time{}
+	commits, err := cr.FilterCommits(&author, &since, &until, &resource, &namespace, &name)
+	assert.NoError(t, err, "unable to filter commits")
+	var messages, authors []string
+	for _, c := range commits {
+		messages = append(messages, strings.SplitN(c.Message, "\n", 2)[0])
+		authors = append(authors, c.Author.Name)
+	}
+	assert.Equal(t, []string{
+		"Deleted custom resource definition clusternetworkpolicies.crd.antrea.io",
+		"Deleted namespace nsA",
+		"Initial commit of existing policies",
+	}, messages, "deleting an untracked CRD should not be committed")
+	assert.Equal(t, []string{"bob", "alice", "audit-init"}, authors)
+}
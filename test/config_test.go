@@ -0,0 +1,305 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"antrea-audit/gitops"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const trackedResourcesConfig = `resources:
+- group: networking.k8s.io
+  version: v1
+  kind: NetworkPolicy
+  resource: networkpolicies
+  namespaced: true
+  dir: k8s-policies
+  displayName: K8s network policy
+- group: ""
+  version: v1
+  kind: Namespace
+  resource: namespaces
+  dir: namespaces
+  displayName: Namespace
+`
+
+const scrubConfig = `scrub:
+- annotations:
+  - ci.example.com/*
+  action: Redact
+- group: networking.k8s.io
+  kind: NetworkPolicy
+  labels:
+  - tool.example.com/*
+`
+
+func TestLoadConfig(t *testing.T) {
+	config, err := gitops.LoadConfig("")
+	assert.NoError(t, err, "unable to load default config")
+	registry, err := gitops.NewResourceRegistry(config.Resources)
+	assert.NoError(t, err, "default tracked resources should be valid")
+	assert.Equal(t, []string{
+		"k8s-policies",
+		"antrea-policies",
+		"antrea-cluster-policies",
+		"antrea-tiers",
+		"antrea-cluster-groups",
+		"antrea-groups",
+		"antrea-external-entities",
+		"antrea-egresses",
+	}, registry.Dirs())
+	resource, ok := registry.ForAPIVersionKind("crd.antrea.io/v1alpha2", "ClusterGroup")
+	assert.True(t, ok, "v1alpha2 cluster groups should be tracked")
+	assert.Equal(t, "antrea-cluster-groups", resource.Dir)
+
+	_, err = gitops.NewResourceRegistry([]gitops.TrackedResource{
+		{Group: "crd.antrea.io", Version: "v1alpha1", Kind: "Tier", Resource: "tiers", Dir: "tiers"},
+		{Group: "crd.antrea.io", Version: "v1alpha1", Kind: "ClusterNetworkPolicy", Resource: "clusternetworkpolicies", Dir: "tiers"},
+	})
+	assert.Error(t, err, "should not allow two tracked resources in the same directory")
+
+	_, err = gitops.LoadConfig("./files/does-not-exist.yaml")
+	assert.Error(t, err, "should have returned error on missing config file")
+}
+
+func TestSetupRepoWithConfig(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "audit-config")
+	assert.NoError(t, err, "unable to create temp dir")
+	defer os.RemoveAll(tmpDir)
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	err = ioutil.WriteFile(configPath, []byte(trackedResourcesConfig), 0600)
+	assert.NoError(t, err, "unable to write config file")
+
+	config, err := gitops.LoadConfig(configPath)
+	assert.NoError(t, err, "unable to load config")
+	registry, err := gitops.NewResourceRegistry(config.Resources)
+	assert.NoError(t, err, "unable to build resource registry")
+
+	ns := &corev1.Namespace{
+		TypeMeta:   metav1.TypeMeta{Kind: "Namespace", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "nsA", UID: "uidNs"},
+	}
+	scheme := runtime.NewScheme()
+	registry.RegisterTypes(scheme)
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(np1.DeepCopy(), ns).Build()
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+
+	cr, err := gitops.SetupRepoWithConfig(k8s, gitops.StorageModeInMemory, dir, config)
+	assert.NoError(t, err, "unable to set up repo with config")
+	_, err = cr.Fs.Stat("namespaces/nsA.yaml")
+	assert.NoError(t, err, "namespace should be tracked")
+	_, err = cr.Fs.Stat("k8s-policies/nsA/npA.yaml")
+	assert.NoError(t, err, "k8s network policy should be tracked")
+	_, err = cr.Fs.Stat("antrea-policies")
+	assert.Error(t, err, "antrea network policies should not be tracked")
+}
+
+func TestRegisterTypes(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "audit-config")
+	assert.NoError(t, err, "unable to create temp dir")
+	defer os.RemoveAll(tmpDir)
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	err = ioutil.WriteFile(configPath, []byte(trackedResourcesConfig), 0600)
+	assert.NoError(t, err, "unable to write config file")
+	config, err := gitops.LoadConfig(configPath)
+	assert.NoError(t, err, "unable to load config")
+	registry, err := gitops.NewResourceRegistry(config.Resources)
+	assert.NoError(t, err, "unable to build resource registry")
+
+	scheme := runtime.NewScheme()
+	registry.RegisterTypes(scheme)
+	for _, gvk := range []schema.GroupVersionKind{
+		{Group: "networking.k8s.io", Version: "v1", Kind: "NetworkPolicy"},
+		{Group: "networking.k8s.io", Version: "v1", Kind: "NetworkPolicyList"},
+		{Group: "networking.k8s.io", Version: "v1", Kind: "ListOptions"},
+		{Group: "", Version: "v1", Kind: "Namespace"},
+		{Group: "", Version: "v1", Kind: "NamespaceList"},
+		{Group: "", Version: "v1", Kind: "ListOptions"},
+	} {
+		assert.True(t, scheme.Recognizes(gvk), "%s should be registered", gvk)
+	}
+	antreaGVK := schema.GroupVersionKind{Group: "crd.antrea.io", Version: "v1alpha1", Kind: "NetworkPolicy"}
+	assert.False(t, scheme.Recognizes(antreaGVK), "untracked kinds should not be registered")
+}
+
+func TestScrubRules(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "audit-config")
+	assert.NoError(t, err, "unable to create temp dir")
+	defer os.RemoveAll(tmpDir)
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	err = ioutil.WriteFile(configPath, []byte(scrubConfig), 0600)
+	assert.NoError(t, err, "unable to write config file")
+	config, err := gitops.LoadConfig(configPath)
+	assert.NoError(t, err, "unable to load config")
+	assert.Len(t, config.Scrub, 2)
+
+	npA := np1.DeepCopy()
+	npA.Annotations = map[string]string{"ci.example.com/token": "secret", "owner": "team-a"}
+	npA.Labels = map[string]string{"tool.example.com/revision": "3", "app": "old"}
+	k8s := &gitops.K8sClient{
+		Client: NewClient(npA, np2.DeepCopy(), anp1.DeepCopy()),
+	}
+	cr, err := gitops.SetupRepoWithConfig(k8s, gitops.StorageModeInMemory, dir, config)
+	assert.NoError(t, err, "unable to set up repo with scrub rules")
+	f, err := cr.Fs.Open("k8s-policies/nsA/npA.yaml")
+	assert.NoError(t, err, "unable to open resource file")
+	y, err := ioutil.ReadAll(f)
+	f.Close()
+	assert.NoError(t, err, "unable to read resource file")
+	assert.Contains(t, string(y), "ci.example.com/token: REDACTED")
+	assert.Contains(t, string(y), "owner: team-a")
+	assert.Contains(t, string(y), "app: old")
+	assert.NotContains(t, string(y), "secret")
+	assert.NotContains(t, string(y), "tool.example.com")
+
+	// Rolling back must neither apply the redacted value nor remove the dropped label.
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	live := &unstructured.Unstructured{}
+	live.SetGroupVersionKind(schema.GroupVersionKind{Group: "networking.k8s.io", Version: "v1", Kind: "NetworkPolicy"})
+	_, err = k8s.GetResource(live, "nsA", "npA")
+	assert.NoError(t, err, "unable to get policy")
+	live.SetAnnotations(map[string]string{"ci.example.com/token": "rotated", "owner": "team-a"})
+	live.SetLabels(map[string]string{"tool.example.com/revision": "4", "app": "new"})
+	live.SetResourceVersion("")
+	err = k8s.CreateOrUpdateResource(live)
+	assert.NoError(t, err, "unable to update policy")
+	jsonStr, err := ioutil.ReadFile("./files/rollback-log.txt")
+	assert.NoError(t, err, "could not read rollback-log file")
+	err = cr.HandleEventList(jsonStr)
+	assert.NoError(t, err, "could not process audit events from file")
+	commit, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get initial commit")
+	_, err = cr.RollbackRepo(commit)
+	assert.NoError(t, err, "rollback failed")
+
+	live = &unstructured.Unstructured{}
+	live.SetGroupVersionKind(schema.GroupVersionKind{Group: "networking.k8s.io", Version: "v1", Kind: "NetworkPolicy"})
+	_, err = k8s.GetResource(live, "nsA", "npA")
+	assert.NoError(t, err, "unable to get policy after rollback")
+	assert.Equal(t, map[string]string{"ci.example.com/token": "rotated", "owner": "team-a"}, live.GetAnnotations())
+	assert.Equal(t, map[string]string{"tool.example.com/revision": "4", "app": "old"}, live.GetLabels())
+
+	_, err = gitops.SetupRepoWithConfig(k8s, gitops.StorageModeInMemory, dir, &gitops.Config{
+		Resources: config.Resources,
+		Scrub:     []gitops.ScrubRule{{Labels: []string{"["}}},
+	})
+	assert.Error(t, err, "should reject invalid scrub patterns")
+}
+
+const coreGroupScrubConfig = `scrub:
+- group: ""
+  kind: NetworkPolicy
+  labels:
+  - app
+`
+
+func TestScrubRuleGroups(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "audit-config")
+	assert.NoError(t, err, "unable to create temp dir")
+	defer os.RemoveAll(tmpDir)
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	err = ioutil.WriteFile(configPath, []byte(coreGroupScrubConfig), 0600)
+	assert.NoError(t, err, "unable to write config file")
+	config, err := gitops.LoadConfig(configPath)
+	assert.NoError(t, err, "unable to load config")
+
+	// a rule for the core group does not apply to kinds of the same name in other groups
+	npA := np1.DeepCopy()
+	npA.Labels = map[string]string{"app": "old"}
+	k8s := &gitops.K8sClient{
+		Client: NewClient(npA),
+	}
+	cr, err := gitops.SetupRepoWithConfig(k8s, gitops.StorageModeInMemory, dir, config)
+	assert.NoError(t, err, "unable to set up repo with scrub rules")
+	f, err := cr.Fs.Open("k8s-policies/nsA/npA.yaml")
+	assert.NoError(t, err, "unable to open resource file")
+	y, err := ioutil.ReadAll(f)
+	f.Close()
+	assert.NoError(t, err, "unable to read resource file")
+	assert.Contains(t, string(y), "app: old")
+
+	_, err = gitops.SetupRepoWithConfig(k8s, gitops.StorageModeInMemory, dir, &gitops.Config{
+		Resources: config.Resources,
+		Scrub:     []gitops.ScrubRule{{Kind: "NetworkPolicy", Labels: []string{"app"}}},
+	})
+	assert.Error(t, err, "should reject scrub rules with a kind but no group")
+}
+
+const ingestionRulesConfig = `ingestion:
+  rules:
+  - action: Include
+    users:
+    - kubernetes-admin
+  - action: Exclude
+    users:
+    - system:serviceaccount:ci:*
+  - action: Exclude
+    groups:
+    - bots
+  - action: Exclude
+    userAgents:
+    - policy-controller/*
+  - action: Exclude
+    namespaces:
+    - sandbox-*
+    verbs:
+    - patch
+    - update
+`
+
+func TestIngestionRules(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "audit-config")
+	assert.NoError(t, err, "unable to create temp dir")
+	defer os.RemoveAll(tmpDir)
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	err = ioutil.WriteFile(configPath, []byte(ingestionRulesConfig), 0600)
+	assert.NoError(t, err, "unable to write config file")
+	config, err := gitops.LoadConfig(configPath)
+	assert.NoError(t, err, "unable to load config")
+	assert.Len(t, config.Ingestion.Rules, 5)
+
+	k8s := &gitops.K8sClient{
+		Client: NewClient(np1.DeepCopy()),
+	}
+	cr, err := gitops.SetupRepoWithConfig(k8s, gitops.StorageModeInMemory, dir, config)
+	assert.NoError(t, err, "unable to set up repo with ingestion rules")
+	jsonStr, err := ioutil.ReadFile("./files/rules-audit-log.txt")
+	assert.NoError(t, err, "could not read rules-audit-log file")
+	err = cr.HandleEventList(jsonStr)
+	assert.NoError(t, err, "could not process audit events from file")
+
+	author, resource, namespace, name := "", "", "", ""
+	since, until := time.Time{}, time.Time{}
+	commits, err := cr.FilterCommits(&author, &since, &until, &resource, &namespace, &name)
+	assert.NoError(t, err, "unable to filter commits")
+	var messages []string
+	for _, c := range commits {
+		messages = append(messages, strings.SplitN(c.Message, "\n", 2)[0])
+	}
+	assert.Equal(t, []string{
+		"Created K8s network policy sandbox-1/npS",
+		"Created K8s network policy nsA/npC",
+		"Initial commit of existing policies",
+	}, messages)
+
+	_, err = gitops.SetupRepoWithConfig(k8s, gitops.StorageModeInMemory, dir, &gitops.Config{
+		Resources: config.Resources,
+		Ingestion: gitops.IngestionConfig{Rules: []gitops.EventRule{{Users: []string{"alice"}}}},
+	})
+	assert.Error(t, err, "should reject rules without action")
+}
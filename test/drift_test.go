@@ -0,0 +1,91 @@
+package test
+
+import (
+	"testing"
+
+	"antrea-audit/gitops"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestDriftDetection(t *testing.T) {
+	k8s := &gitops.K8sClient{
+		Client: NewClient(np1.DeepCopy(), anp1.DeepCopy()),
+	}
+	config := gitops.DefaultConfig()
+	config.Drift.Interval = metav1.Duration{Duration: -1}
+	cr, err := gitops.SetupRepoWithConfig(k8s, gitops.StorageModeInMemory, dir, config)
+	assert.NoError(t, err, "unable to set up repo")
+	detector, err := gitops.NewDriftDetector(cr)
+	assert.NoError(t, err, "unable to create drift detector")
+	assert.Nil(t, detector.LastReport())
+	report, err := detector.Check()
+	assert.NoError(t, err, "unable to check for drift")
+	assert.Empty(t, report.Resources, "repository should match the cluster after setup")
+
+	// Change the cluster without sending audit events
+	r := unstructured.Unstructured{}
+	r.Object, err = runtime.DefaultUnstructuredConverter.ToUnstructured(np2)
+	assert.NoError(t, err, "unable to convert typed to unstructured object")
+	err = k8s.CreateOrUpdateResource(&r)
+	assert.NoError(t, err, "unable to create new resource")
+	r = unstructured.Unstructured{}
+	r.SetGroupVersionKind(schema.GroupVersionKind{Group: "networking.k8s.io", Version: "v1", Kind: "NetworkPolicy"})
+	_, err = k8s.GetResource(&r, "nsA", "npA")
+	assert.NoError(t, err, "unable to get policy")
+	r.SetLabels(map[string]string{"app": "drifted"})
+	r.SetResourceVersion("")
+	err = k8s.CreateOrUpdateResource(&r)
+	assert.NoError(t, err, "unable to update policy")
+	r = unstructured.Unstructured{}
+	r.Object, err = runtime.DefaultUnstructuredConverter.ToUnstructured(anp1)
+	assert.NoError(t, err, "unable to convert typed to unstructured object")
+	err = k8s.DeleteResource(&r)
+	assert.NoError(t, err, "unable to delete resource")
+
+	head, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	report, err = detector.Check()
+	assert.NoError(t, err, "unable to check for drift")
+	assert.Equal(t, []gitops.DriftedResource{
+		{Path: "antrea-policies/nsA/anpA.yaml", Change: gitops.DriftRemoved},
+		{Path: "k8s-policies/nsA/npA.yaml", Change: gitops.DriftModified},
+		{Path: "k8s-policies/nsA/npB.yaml", Change: gitops.DriftAdded},
+	}, report.Resources)
+	assert.Empty(t, report.Commit, "drift should only be reported by default")
+	assert.Equal(t, report, detector.LastReport())
+	newHead, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	assert.Equal(t, head.Hash(), newHead.Hash(), "reporting drift should not commit")
+
+	cr.Config.Drift.Mode = gitops.DriftModeCommit
+	detector, err = gitops.NewDriftDetector(cr)
+	assert.NoError(t, err, "unable to create drift detector")
+	report, err = detector.Check()
+	assert.NoError(t, err, "unable to check for drift")
+	assert.Len(t, report.Resources, 3)
+	newHead, err = cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	assert.Equal(t, newHead.Hash().String(), report.Commit)
+	commit, err := cr.Repo.CommitObject(newHead.Hash())
+	assert.NoError(t, err, "unable to get drift commit")
+	assert.Equal(t, "Drift: update repository to match cluster state\n\n"+
+		"Removed antrea-policies/nsA/anpA.yaml\n"+
+		"Modified k8s-policies/nsA/npA.yaml\n"+
+		"Added k8s-policies/nsA/npB.yaml", commit.Message)
+	_, err = cr.Fs.Stat("antrea-policies/nsA/anpA.yaml")
+	assert.Error(t, err, "removed resource should no longer be in the repository")
+
+	report, err = detector.Check()
+	assert.NoError(t, err, "unable to check for drift")
+	assert.Empty(t, report.Resources, "repository should match the cluster after the drift commit")
+	assert.Empty(t, report.Commit)
+
+	cr.Config.Drift.Mode = "Sometimes"
+	_, err = gitops.NewDriftDetector(cr)
+	assert.Error(t, err, "should reject unknown drift modes")
+}
@@ -2,10 +2,14 @@ package test
 
 import (
 	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"antrea-audit/gitops"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestFilterCommits(t *testing.T) {
@@ -48,3 +52,85 @@ func TestFilterCommits(t *testing.T) {
 		}
 	}
 }
+
+func TestFilterCommitsByEventTime(t *testing.T) {
+	empty := ""
+	fakeClient := NewClient(Np1.inputResource)
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	jsonStr, err := ioutil.ReadFile("./files/stale-audit-log.txt")
+	assert.NoError(t, err, "cannot read stale-audit-log.txt")
+	// commit dates are stored with a one second precision
+	start := time.Now().Truncate(time.Second)
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, empty)
+	assert.NoError(t, err, "unable to set up repo")
+	err = cr.HandleEventList(jsonStr)
+	assert.NoError(t, err, "cannot handle this event list")
+
+	since := time.Date(2021, 7, 14, 22, 0, 0, 0, time.UTC)
+	until := time.Date(2021, 7, 14, 22, 30, 0, 0, time.UTC)
+	commits, err := cr.FilterCommits(&empty, &since, &until, &empty, &empty, &empty)
+	assert.NoError(t, err, "unable to filter commits")
+	if assert.Len(t, commits, 1) {
+		c := commits[0]
+		assert.Equal(t, "kubernetes-admin", c.Author.Name)
+		assert.True(t, c.Author.When.Equal(time.Date(2021, 7, 14, 22, 10, 0, 0, time.UTC)), "author date should be the event time")
+		assert.False(t, c.Committer.When.Before(start), "committer date should be the processing time")
+	}
+
+	commits, err = cr.FilterCommits(&empty, &start, &time.Time{}, &empty, &empty, &empty)
+	assert.NoError(t, err, "unable to filter commits")
+	if assert.Len(t, commits, 1) {
+		assert.Equal(t, "audit-init", commits[0].Author.Name)
+	}
+}
+
+func TestGenerateName(t *testing.T) {
+	empty := ""
+	fakeClient := NewClient(np1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, empty)
+	assert.NoError(t, err, "unable to set up repo")
+
+	// the create event is handled first so that the file can be checked
+	jsonStr, err := ioutil.ReadFile("./files/generatename-audit-log.txt")
+	assert.NoError(t, err, "cannot read generatename-audit-log.txt")
+	events, err := gitops.ParseEvents(jsonStr)
+	assert.NoError(t, err, "cannot parse generatename-audit-log.txt")
+	err = cr.HandleEvents(events[:1])
+	assert.NoError(t, err, "cannot handle create event")
+	_, err = cr.Fs.Stat("k8s-policies/nsA/np-x7k2q.yaml")
+	assert.NoError(t, err, "resource file should be named after the generated name")
+	_, err = cr.Fs.Stat("k8s-policies/nsA/.yaml")
+	assert.True(t, os.IsNotExist(err), "resource file should not be named after the empty request name")
+
+	err = cr.HandleEvents(events[1:])
+	assert.NoError(t, err, "cannot handle delete event")
+	_, err = cr.Fs.Stat("k8s-policies/nsA/np-x7k2q.yaml")
+	assert.True(t, os.IsNotExist(err), "resource file should be deleted")
+
+	resource, namespace, name := "k8s-policies", "nsA", "np-x7k2q"
+	commits, err := cr.FilterCommits(&empty, &time.Time{}, &time.Time{}, &resource, &namespace, &name)
+	assert.NoError(t, err, "unable to filter commits")
+	var messages []string
+	for _, c := range commits {
+		messages = append(messages, strings.SplitN(c.Message, "\n", 2)[0])
+	}
+	assert.Equal(t, []string{
+		"Deleted K8s network policy nsA/np-x7k2q",
+		"Created K8s network policy nsA/np-x7k2q",
+	}, messages)
+
+	// names are matched exactly
+	name = "np"
+	commits, err = cr.FilterCommits(&empty, &time.Time{}, &time.Time{}, &empty, &namespace, &name)
+	assert.NoError(t, err, "unable to filter commits")
+	assert.Empty(t, commits)
+	name = "npA"
+	commits, err = cr.FilterCommits(&empty, &time.Time{}, &time.Time{}, &empty, &namespace, &name)
+	assert.NoError(t, err, "unable to filter commits")
+	assert.Len(t, commits, 1)
+}
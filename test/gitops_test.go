@@ -1,8 +1,12 @@
 package test
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -21,6 +25,7 @@ import (
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 var (
@@ -101,10 +106,21 @@ func TestHandleEventList(t *testing.T) {
 	err = cr.HandleEventList(jsonstring)
 	assert.NoError(t, err, "could not handle correct audit event list")
 
-	cr.RollbackMode = true
+	// Already processed events are skipped
 	err = cr.HandleEventList(jsonstring)
+	assert.NoError(t, err, "could not handle retried audit event list")
+
+	rollbackJson, err := ioutil.ReadFile("./files/rollback-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	cr.RollbackMode = true
+	err = cr.HandleEventList(rollbackJson)
 	cr.RollbackMode = false
-	assert.EqualError(t, err, "audit skipped - rollback in progress")
+	assert.NoError(t, err, "audit events received during rollback should be spooled")
+	newH, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	assert.Equal(t, h.Hash(), newH.Hash(), "audit events received during rollback should not be committed yet")
 
 	for i := 1; i < 4; i++ {
 		filename := fmt.Sprintf("%s%d%s", "files/incorrect-audit-log-", i, ".txt")
@@ -115,6 +131,766 @@ func TestHandleEventList(t *testing.T) {
 	}
 }
 
+func TestHandleUpdateAndDeleteCollection(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy(), np2.DeepCopy(), anp1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+
+	jsonstring, err := ioutil.ReadFile("./files/collection-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	err = cr.HandleEventList(jsonstring)
+	assert.NoError(t, err, "could not handle update/deletecollection audit event list")
+
+	_, err = cr.Fs.Stat("k8s-policies/nsA/npA.yaml")
+	assert.Error(t, err, "npA should have been removed by deletecollection")
+	_, err = cr.Fs.Stat("k8s-policies/nsA/npB.yaml")
+	assert.Error(t, err, "npB should have been removed by deletecollection")
+	_, err = cr.Fs.Stat("antrea-policies/nsA/anpA.yaml")
+	assert.NoError(t, err, "antrea policy should not be affected by deletecollection")
+
+	cIter, err := cr.Repo.Log(&git.LogOptions{})
+	assert.NoError(t, err, "unable to get repo log")
+	var messages []string
+	err = cIter.ForEach(func(c *object.Commit) error {
+		messages = append(messages, strings.SplitN(c.Message, "\n", 2)[0])
+		return nil
+	})
+	assert.NoError(t, err, "could not iterate through repo log")
+	assert.Equal(t, []string{
+		"Deleted K8s network policy collection nsA",
+		"Updated K8s network policy nsA/npA",
+		"Initial commit of existing policies",
+	}, messages, "unexpected commit history")
+}
+
+func TestHandleDeleteCollectionWithSelector(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy(), np2.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+
+	// Only npB matches the selector of the deletecollection
+	assert.NoError(t, fakeClient.Delete(context.TODO(), np2.DeepCopy()), "unable to delete policy")
+	jsonstring, err := ioutil.ReadFile("./files/selector-collection-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	err = cr.HandleEventList(jsonstring)
+	assert.NoError(t, err, "could not handle deletecollection with selector")
+
+	_, err = cr.Fs.Stat("k8s-policies/nsA/npA.yaml")
+	assert.NoError(t, err, "npA is still in the cluster and should be kept")
+	_, err = cr.Fs.Stat("k8s-policies/nsA/npB.yaml")
+	assert.Error(t, err, "npB should have been removed by deletecollection")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	commit, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get head commit")
+	assert.True(t, strings.HasPrefix(commit.Message, "Deleted K8s network policy collection nsA"))
+}
+
+func TestHandleDeleteCollectionWithSelectorListFailure(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy(), np2.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+
+	assert.NoError(t, fakeClient.Delete(context.TODO(), np2.DeepCopy()), "unable to delete policy")
+	jsonstring, err := ioutil.ReadFile("./files/selector-collection-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	k8s.Client = &unservedGroupClient{Client: fakeClient, group: "networking.k8s.io"}
+	err = cr.HandleEventList(jsonstring)
+	assert.Error(t, err, "deletecollection should fail when the deleted resources cannot be listed")
+	newH, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	assert.Equal(t, h.Hash(), newH.Hash(), "failed deletecollection should not be committed")
+
+	// The event is not marked as processed and is applied when retried
+	k8s.Client = fakeClient
+	err = cr.HandleEventList(jsonstring)
+	assert.NoError(t, err, "could not handle retried deletecollection with selector")
+	_, err = cr.Fs.Stat("k8s-policies/nsA/npB.yaml")
+	assert.Error(t, err, "npB should have been removed by retried deletecollection")
+}
+
+func TestHandleEventListTransaction(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+
+	jsonstring, err := ioutil.ReadFile("./files/partial-failure-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	err = cr.HandleEventList(jsonstring)
+	assert.Error(t, err, "should have returned error on bad audit event")
+
+	newH, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	assert.Equal(t, h.Hash(), newH.Hash(), "failed event list should not leave any commits behind")
+	_, err = cr.Fs.Stat("k8s-policies/nsA/npC.yaml")
+	assert.Error(t, err, "resource created by failed event list should not remain in worktree")
+	w, err := cr.Repo.Worktree()
+	assert.NoError(t, err, "unable to get worktree")
+	status, err := w.Status()
+	assert.NoError(t, err, "unable to get worktree status")
+	assert.True(t, status.IsClean(), "worktree should be clean after failed event list")
+
+	// With a batch size of 1, events preceding the failure are kept
+	cr.Config.Ingestion.BatchSize = 1
+	err = cr.HandleEventList(jsonstring)
+	assert.Error(t, err, "should have returned error on bad audit event")
+	_, err = cr.Fs.Stat("k8s-policies/nsA/npC.yaml")
+	assert.NoError(t, err, "resource from successful batch should be committed")
+}
+
+func TestHandleEventListTransactionNewNamespace(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "audit-transaction")
+	assert.NoError(t, err, "unable to create temp dir")
+	defer os.RemoveAll(tmpDir)
+	fakeClient := NewClient(np1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeDisk, tmpDir)
+	assert.NoError(t, err, "could not set up repo")
+
+	// A file written by a change which was interrupted before being committed
+	assert.NoError(t, cr.Fs.MkdirAll("k8s-policies/nsNew", 0700))
+	f, err := cr.Fs.Create("k8s-policies/nsNew/npD.yaml")
+	assert.NoError(t, err, "unable to create file")
+	assert.NoError(t, f.Close())
+
+	jsonstring, err := ioutil.ReadFile("./files/namespace-failure-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	err = cr.HandleEventList(jsonstring)
+	assert.Error(t, err, "should have returned error on bad audit event")
+	_, err = cr.Fs.Stat("k8s-policies/nsNew/npC.yaml")
+	assert.True(t, os.IsNotExist(err), "resource created in a new namespace by failed event list should not remain in worktree")
+	_, err = cr.Fs.Stat("k8s-policies/nsNew/npD.yaml")
+	assert.True(t, os.IsNotExist(err), "untracked file in a new namespace should be removed")
+	_, err = cr.Fs.Stat("k8s-policies/nsNew")
+	assert.True(t, os.IsNotExist(err), "directory of new namespace should be removed")
+	w, err := cr.Repo.Worktree()
+	assert.NoError(t, err, "unable to get worktree")
+	status, err := w.Status()
+	assert.NoError(t, err, "unable to get worktree status")
+	assert.True(t, status.IsClean(), "worktree should be clean after failed event list")
+
+	// The next event list does not pick up files left by the failed one
+	jsonstring, err = ioutil.ReadFile("./files/rollback-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	assert.NoError(t, cr.HandleEventList(jsonstring), "could not handle audit event list")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	commit, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get head commit")
+	tree, err := commit.Tree()
+	assert.NoError(t, err, "unable to get head tree")
+	_, err = tree.File("k8s-policies/nsNew/npC.yaml")
+	assert.Equal(t, object.ErrFileNotFound, err)
+	_, err = tree.File("k8s-policies/nsNew/npD.yaml")
+	assert.Equal(t, object.ErrFileNotFound, err)
+}
+
+func TestHandleEventListIdempotent(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "audit-dedupe")
+	assert.NoError(t, err, "unable to create temp dir")
+	defer os.RemoveAll(tmpDir)
+	fakeClient := NewClient(np1.DeepCopy(), np2.DeepCopy(), anp1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	jsonstring, err := ioutil.ReadFile("./files/collection-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeDisk, tmpDir)
+	assert.NoError(t, err, "could not set up repo")
+	err = cr.HandleEventList(jsonstring)
+	assert.NoError(t, err, "could not handle audit event list")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	headCommit, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get head commit")
+	assert.Contains(t, headCommit.Message, "Audit-ID: 5f0e2a61-2b0c-4a3e-9d43-0c6d1f1b7a02")
+
+	// Retried batch is ignored
+	err = cr.HandleEventList(jsonstring)
+	assert.NoError(t, err, "could not handle retried audit event list")
+	newH, _ := cr.Repo.Head()
+	assert.Equal(t, h.Hash(), newH.Hash(), "retried audit events should not be committed again")
+
+	// Processed audit IDs survive a restart
+	cr, err = gitops.SetupRepo(k8s, gitops.StorageModeDisk, tmpDir)
+	assert.NoError(t, err, "could not reopen repo")
+	err = cr.HandleEventList(jsonstring)
+	assert.NoError(t, err, "could not handle retried audit event list after restart")
+	newH, _ = cr.Repo.Head()
+	assert.Equal(t, h.Hash(), newH.Hash(), "retried audit events should not be committed after restart")
+
+	// Processed audit IDs are rebuilt from commit trailers if the index is lost
+	err = os.Remove(filepath.Join(tmpDir, "resource-auditing-repo", ".git", "audit", "processed-audit-ids"))
+	assert.NoError(t, err, "unable to remove audit index")
+	cr, err = gitops.SetupRepo(k8s, gitops.StorageModeDisk, tmpDir)
+	assert.NoError(t, err, "could not reopen repo")
+	err = cr.HandleEventList(jsonstring)
+	assert.NoError(t, err, "could not handle retried audit event list after index loss")
+	newH, _ = cr.Repo.Head()
+	assert.Equal(t, h.Hash(), newH.Hash(), "retried audit events should not be committed after index loss")
+}
+
+func TestHandleEventListWithRequestReceivedStage(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+
+	// the RequestReceived event shares its audit ID with the ResponseComplete event
+	jsonstring, err := ioutil.ReadFile("./files/stages-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	err = cr.HandleEventList(jsonstring)
+	assert.NoError(t, err, "could not handle audit event list")
+
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	headCommit, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get head commit")
+	assert.Contains(t, headCommit.Message, "Audit-ID: 7c4e1d2b-5a3f-4e6d-8b9c-1d2e3f4a5b01")
+}
+
+func TestHandleStaleEvents(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+
+	jsonstring, err := ioutil.ReadFile("./files/stale-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	err = cr.HandleEventList(jsonstring)
+	assert.NoError(t, err, "could not handle audit event list")
+
+	newH, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	headCommit, err := cr.Repo.CommitObject(newH.Hash())
+	assert.NoError(t, err, "unable to get head commit")
+	assert.Contains(t, headCommit.Message, "Resource-Version: 2000")
+	parent, err := headCommit.Parent(0)
+	assert.NoError(t, err, "unable to get parent commit")
+	assert.Equal(t, h.Hash(), parent.Hash, "stale event should not be committed")
+
+	file, err := cr.Fs.Open("k8s-policies/nsA/npA.yaml")
+	assert.NoError(t, err, "unable to open file")
+	y, err := ioutil.ReadAll(file)
+	assert.NoError(t, err, "unable to read file")
+	assert.Contains(t, string(y), "app: newer", "stale event should not overwrite newer state")
+}
+
+func TestHandleStaleEventsOpaqueResourceVersion(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+
+	// resource versions which are not integers are ordered by the event timestamps
+	jsonstring, err := ioutil.ReadFile("./files/opaque-version-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	err = cr.HandleEventList(jsonstring)
+	assert.NoError(t, err, "could not handle audit event list")
+
+	newH, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	headCommit, err := cr.Repo.CommitObject(newH.Hash())
+	assert.NoError(t, err, "unable to get head commit")
+	assert.Contains(t, headCommit.Message, "Resource-Version: opaque-2000")
+
+	file, err := cr.Fs.Open("k8s-policies/nsA/npA.yaml")
+	assert.NoError(t, err, "unable to open file")
+	y, err := ioutil.ReadAll(file)
+	assert.NoError(t, err, "unable to read file")
+	assert.Contains(t, string(y), "app: newer", "stale event should not overwrite newer state")
+}
+
+func TestHandleEventsWithoutChanges(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+
+	// npA is updated to its stored state and anpA was never tracked
+	jsonstring, err := ioutil.ReadFile("./files/rollback-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	err = cr.HandleEventList(jsonstring)
+	assert.NoError(t, err, "could not handle audit event list")
+
+	cIter, err := cr.Repo.Log(&git.LogOptions{})
+	assert.NoError(t, err, "unable to get repo log")
+	var messages []string
+	err = cIter.ForEach(func(c *object.Commit) error {
+		messages = append(messages, strings.SplitN(c.Message, "\n", 2)[0])
+		return nil
+	})
+	assert.NoError(t, err, "could not iterate through repo log")
+	assert.Equal(t, []string{
+		"Created K8s network policy nsA/npB",
+		"Initial commit of existing policies",
+	}, messages, "events which do not change the repository should not be committed")
+}
+
+func TestProvenanceTrailers(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	jsonstring, err := ioutil.ReadFile("./files/stale-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	err = cr.HandleEventList(jsonstring)
+	assert.NoError(t, err, "could not handle audit event list")
+
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	commit, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get head commit")
+	expProvenance := gitops.Provenance{
+		AuditID:          "3b9d6c2a-1f4e-4d8b-a7c5-2e6f9a0b1c01",
+		ResourceVersion:  "2000",
+		SourceIPs:        []string{"192.168.77.1"},
+		UserAgent:        "kubectl/v1.21.1 (darwin/amd64) kubernetes/5e58841",
+		RequestURI:       "/apis/networking.k8s.io/v1/namespaces/nsA/networkpolicies/npA?fieldManager=kubectl-client-side-apply",
+		Groups:           []string{"system:masters", "system:authenticated"},
+		ImpersonatedUser: "alice",
+	}
+	assert.Equal(t, expProvenance, gitops.ParseProvenance(commit.Message))
+
+	initCommit, err := commit.Parent(0)
+	assert.NoError(t, err, "unable to get parent commit")
+	assert.Equal(t, gitops.Provenance{}, gitops.ParseProvenance(initCommit.Message))
+}
+
+func TestRollbackReplaysJournal(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy(), anp1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	initCommit, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get head commit")
+
+	rollbackJson, err := ioutil.ReadFile("./files/rollback-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	labelJson, err := ioutil.ReadFile("./files/label-update-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	cr.RollbackMode = true
+	err = cr.HandleEventList(rollbackJson)
+	assert.NoError(t, err, "audit events received during rollback should be spooled")
+	err = cr.HandleEventList(labelJson)
+	assert.NoError(t, err, "audit events received during rollback should be spooled")
+	cr.RollbackMode = false
+
+	_, err = cr.RollbackRepo(initCommit)
+	assert.NoError(t, err, "could not rollback repo")
+	newH, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	cIter, err := cr.Repo.Log(&git.LogOptions{From: newH.Hash()})
+	assert.NoError(t, err, "unable to get repo log")
+	var messages []string
+	cIter.ForEach(func(c *object.Commit) error {
+		messages = append(messages, strings.SplitN(c.Message, "\n", 2)[0])
+		return nil
+	})
+	assert.Equal(t, []string{
+		"Updated K8s network policy nsA/npA",
+		"Deleted Antrea network policy nsA/anpA",
+		"Created K8s network policy nsA/npB",
+		"Rollback to commit " + initCommit.Hash.String(),
+		"Initial commit of existing policies",
+	}, messages)
+
+	// Replayed events are not applied again
+	err = cr.HandleEventList(rollbackJson)
+	assert.NoError(t, err, "could not handle retried audit event list")
+	err = cr.HandleEventList(labelJson)
+	assert.NoError(t, err, "could not handle retried audit event list")
+	lastH, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	assert.Equal(t, newH.Hash(), lastH.Hash())
+}
+
+func TestReplayJournalFailureKeepsEvents(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy(), anp1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+
+	// the resources deleted by the selector cannot be listed
+	k8s.Client = &unservedGroupClient{Client: fakeClient, group: "networking.k8s.io"}
+	failingJson, err := ioutil.ReadFile("./files/selector-collection-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	cr.RollbackMode = true
+	err = cr.HandleEventList(failingJson)
+	assert.NoError(t, err, "audit events received during rollback should be spooled")
+	cr.RollbackMode = false
+
+	// The spooled events which cannot be applied yet are kept and retried with the next events
+	rollbackJson, err := ioutil.ReadFile("./files/rollback-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	err = cr.HandleEventList(rollbackJson)
+	assert.Error(t, err, "replaying spooled audit events should fail")
+	err = cr.HandleEventList(rollbackJson)
+	assert.Error(t, err, "spooled audit events should be replayed again")
+	newH, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	assert.Equal(t, h.Hash(), newH.Hash())
+}
+
+func TestReplayJournalDeadLettersUnsupportedEvents(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "audit-journal")
+	assert.NoError(t, err, "unable to create temp dir")
+	defer os.RemoveAll(tmpDir)
+	fakeClient := NewClient(np1.DeepCopy(), anp1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeDisk, tmpDir)
+	assert.NoError(t, err, "could not set up repo")
+
+	// the response object of the patch of npA cannot be read
+	failingJson, err := ioutil.ReadFile("./files/partial-failure-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	cr.RollbackMode = true
+	err = cr.HandleEventList(failingJson)
+	assert.NoError(t, err, "audit events received during rollback should be spooled")
+	cr.RollbackMode = false
+
+	labelJson, err := ioutil.ReadFile("./files/label-update-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	err = cr.HandleEventList(labelJson)
+	assert.NoError(t, err, "spooled audit events which can never be applied should not block new events")
+	_, err = cr.Fs.Stat("k8s-policies/nsA/npC.yaml")
+	assert.NoError(t, err, "spooled audit events which can be applied should be committed")
+	stateDir := filepath.Join(tmpDir, "resource-auditing-repo", ".git", "audit")
+	_, err = os.Stat(filepath.Join(stateDir, "rollback-journal.jsonl"))
+	assert.True(t, os.IsNotExist(err), "rollback journal should be cleared")
+	deadLetters, err := ioutil.ReadFile(filepath.Join(stateDir, "rollback-journal-dead-letter.jsonl"))
+	assert.NoError(t, err, "unable to read dead-letter journal")
+	assert.Equal(t, 1, strings.Count(string(deadLetters), "\n"), "event which can never be applied should be set aside")
+	assert.Contains(t, string(deadLetters), `"name":"npA"`)
+}
+
+func TestPlanRollback(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy(), anp1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	initCommit, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get head commit")
+
+	rollbackJson, err := ioutil.ReadFile("./files/rollback-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	err = cr.HandleEventList(rollbackJson)
+	assert.NoError(t, err, "could not handle audit event list")
+	labelJson, err := ioutil.ReadFile("./files/label-update-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	err = cr.HandleEventList(labelJson)
+	assert.NoError(t, err, "could not handle audit event list")
+	newH, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	before := &networkingv1.NetworkPolicy{}
+	err = fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "nsA", Name: "npA"}, before)
+	assert.NoError(t, err, "unable to get network policy")
+
+	plan, err := cr.PlanRollback(initCommit)
+	assert.NoError(t, err, "could not compute rollback plan")
+	assert.Equal(t, newH.Hash().String(), plan.Head)
+	assert.Equal(t, initCommit.Hash.String(), plan.Target)
+	actions := map[string]gitops.RollbackAction{}
+	for _, change := range plan.Changes {
+		actions[change.Path] = change.Action
+		assert.Contains(t, change.Diff, change.Path)
+	}
+	assert.Equal(t, map[string]gitops.RollbackAction{
+		"antrea-policies/nsA/anpA.yaml": gitops.RollbackCreate,
+		"k8s-policies/nsA/npA.yaml":     gitops.RollbackUpdate,
+		"k8s-policies/nsA/npB.yaml":     gitops.RollbackDelete,
+	}, actions)
+	for _, change := range plan.Changes {
+		if change.Path == "k8s-policies/nsA/npB.yaml" {
+			assert.Equal(t, "NetworkPolicy", change.Kind)
+			assert.Equal(t, "nsA", change.Namespace)
+			assert.Equal(t, "npB", change.Name)
+		}
+	}
+
+	// Neither the repository nor the cluster are modified
+	lastH, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	assert.Equal(t, newH.Hash(), lastH.Hash())
+	_, err = cr.Fs.Stat("k8s-policies/nsA/npB.yaml")
+	assert.NoError(t, err, "worktree should not be modified")
+	assert.False(t, cr.RollbackMode)
+	current := &networkingv1.NetworkPolicy{}
+	err = fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "nsA", Name: "npA"}, current)
+	assert.NoError(t, err, "unable to get network policy")
+	assert.Equal(t, before.ResourceVersion, current.ResourceVersion, "cluster should not be modified")
+}
+
+// failingClient fails the creation and update of the resource with the given name.
+type failingClient struct {
+	client.Client
+	name string
+}
+
+func (c *failingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if obj.GetName() == c.name {
+		return fmt.Errorf("injected create failure\nfor %s", obj.GetName())
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func (c *failingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	if obj.GetName() == c.name {
+		return fmt.Errorf("injected update failure\nfor %s", obj.GetName())
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+func TestRollbackWithoutTarget(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+
+	_, err = cr.PlanRollback(nil)
+	assert.ErrorIs(t, err, gitops.ErrNoTargetCommit)
+	_, err = cr.RollbackRepo(nil)
+	assert.ErrorIs(t, err, gitops.ErrNoTargetCommit)
+	assert.Equal(t, 1, countCommits(t, cr))
+}
+
+func TestRollbackFailureIsCompensated(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy(), anp1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	initCommit, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get head commit")
+
+	r := unstructured.Unstructured{}
+	r.SetGroupVersionKind(schema.GroupVersionKind{
+		Group:   "networking.k8s.io",
+		Version: "v1",
+		Kind:    "NetworkPolicy",
+	})
+	r.Object, err = runtime.DefaultUnstructuredConverter.ToUnstructured(np2)
+	assert.NoError(t, err, "unable to convert typed to unstructured object")
+	err = k8s.CreateOrUpdateResource(&r)
+	assert.NoError(t, err, "unable to create new resource")
+	rollbackJson, err := ioutil.ReadFile("./files/rollback-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	err = cr.HandleEventList(rollbackJson)
+	assert.NoError(t, err, "could not handle audit event list")
+	labelJson, err := ioutil.ReadFile("./files/label-update-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	err = cr.HandleEventList(labelJson)
+	assert.NoError(t, err, "could not handle audit event list")
+	newH, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	newCommit, err := cr.Repo.CommitObject(newH.Hash())
+	assert.NoError(t, err, "unable to get head commit")
+	anpBefore := &crdv1alpha1.NetworkPolicy{}
+	err = fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "nsA", Name: "anpA"}, anpBefore)
+	assert.NoError(t, err, "unable to get antrea network policy")
+	anpBefore.Labels = map[string]string{"app": "live"}
+	err = fakeClient.Update(context.TODO(), anpBefore)
+	assert.NoError(t, err, "unable to update antrea network policy")
+
+	// npB is deleted and anpA is updated before the update of npA fails
+	k8s.Client = &failingClient{Client: fakeClient, name: "npA"}
+	_, err = cr.RollbackRepo(initCommit)
+	assert.Error(t, err, "rollback should fail")
+	assert.False(t, cr.RollbackMode, "rollback mode should be cleared")
+
+	npB := &networkingv1.NetworkPolicy{}
+	err = fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "nsA", Name: "npB"}, npB)
+	assert.NoError(t, err, "resource deleted by failed rollback should be restored")
+	assert.Equal(t, np2.Spec, npB.Spec)
+	anpA := &crdv1alpha1.NetworkPolicy{}
+	err = fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "nsA", Name: "anpA"}, anpA)
+	assert.NoError(t, err, "resource updated by failed rollback should be restored")
+	assert.Equal(t, anpBefore.Spec, anpA.Spec)
+	assert.Equal(t, anpBefore.Labels, anpA.Labels)
+	assert.Equal(t, anpBefore.Annotations, anpA.Annotations)
+
+	// The failed attempt is recorded on top of the original HEAD, without changing the tree
+	lastH, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	commit, err := cr.Repo.CommitObject(lastH.Hash())
+	assert.NoError(t, err, "unable to get head commit")
+	assert.True(t, strings.HasPrefix(commit.Message, "Failed rollback to commit "+initCommit.Hash.String()))
+	assert.Contains(t, commit.Message, "Rollback-Error: ")
+	assert.NotContains(t, commit.Message, "Compensation-Error: ")
+	for _, line := range strings.Split(commit.Message, "\n") {
+		if strings.HasPrefix(line, "Rollback-Error: ") {
+			assert.Contains(t, line, "injected create failure for npA", "trailer value should be on a single line")
+		}
+	}
+	parent, err := commit.Parent(0)
+	assert.NoError(t, err, "unable to get parent commit")
+	assert.Equal(t, newH.Hash(), parent.Hash)
+	assert.Equal(t, newCommit.TreeHash, commit.TreeHash)
+	_, err = cr.Fs.Stat("k8s-policies/nsA/npB.yaml")
+	assert.NoError(t, err, "worktree should be restored")
+	_, err = cr.Fs.Stat("antrea-policies/nsA/anpA.yaml")
+	assert.True(t, os.IsNotExist(err), "worktree should be restored")
+
+	// Once the failure is fixed, the rollback succeeds
+	k8s.Client = fakeClient
+	_, err = cr.RollbackRepo(initCommit)
+	assert.NoError(t, err, "could not rollback repo")
+}
+
+func TestHandleEventWithoutResponseObject(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	current := &networkingv1.NetworkPolicy{}
+	err = fakeClient.Get(context.TODO(), client.ObjectKey{Namespace: "nsA", Name: "npA"}, current)
+	assert.NoError(t, err, "unable to get network policy")
+	current.Labels = map[string]string{"app": "reconstructed"}
+	err = fakeClient.Update(context.TODO(), current)
+	assert.NoError(t, err, "unable to update network policy")
+
+	jsonstring, err := ioutil.ReadFile("./files/metadata-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	err = cr.HandleEventList(jsonstring)
+	assert.NoError(t, err, "could not handle audit event list")
+
+	newH, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	commit, err := cr.Repo.CommitObject(newH.Hash())
+	assert.NoError(t, err, "unable to get head commit")
+	assert.True(t, strings.HasPrefix(commit.Message, "Updated K8s network policy nsA/npA"))
+	provenance := gitops.ParseProvenance(commit.Message)
+	assert.True(t, provenance.Reconstructed, "commit should be marked as reconstructed")
+	assert.Equal(t, current.ResourceVersion, provenance.ResourceVersion)
+	// the event for a resource which no longer exists is skipped
+	parent, err := commit.Parent(0)
+	assert.NoError(t, err, "unable to get parent commit")
+	assert.Equal(t, h.Hash(), parent.Hash)
+
+	file, err := cr.Fs.Open("k8s-policies/nsA/npA.yaml")
+	assert.NoError(t, err, "unable to open file")
+	y, err := ioutil.ReadAll(file)
+	assert.NoError(t, err, "unable to read file")
+	assert.Contains(t, string(y), "app: reconstructed")
+}
+
+func TestHandleAttemptedChanges(t *testing.T) {
+	for _, recordAttempts := range []bool{false, true} {
+		fakeClient := NewClient(np1.DeepCopy())
+		k8s := &gitops.K8sClient{
+			Client: fakeClient,
+		}
+		config := gitops.DefaultConfig()
+		config.Ingestion.RecordAttempts = recordAttempts
+		cr, err := gitops.SetupRepoWithConfig(k8s, gitops.StorageModeInMemory, dir, config)
+		assert.NoError(t, err, "could not set up repo")
+		h, err := cr.Repo.Head()
+		assert.NoError(t, err, "unable to get repo head ref")
+
+		jsonstring, err := ioutil.ReadFile("./files/attempts-audit-log.txt")
+		assert.NoError(t, err, "unable to read mock audit log")
+		err = cr.HandleEventList(jsonstring)
+		assert.NoError(t, err, "could not handle audit event list")
+		// retried events are not recorded twice
+		err = cr.HandleEventList(jsonstring)
+		assert.NoError(t, err, "could not handle retried audit event list")
+
+		newH, err := cr.Repo.Head()
+		assert.NoError(t, err, "unable to get repo head ref")
+		assert.Equal(t, h.Hash(), newH.Hash(), "dry-run and subresource requests should not be committed")
+		attempts, err := cr.AttemptedChanges()
+		assert.NoError(t, err, "unable to read attempted changes")
+		if !recordAttempts {
+			assert.Empty(t, attempts)
+			continue
+		}
+		if assert.Len(t, attempts, 2) {
+			assert.True(t, attempts[0].DryRun)
+			assert.Equal(t, "patch", attempts[0].Verb)
+			assert.Equal(t, "npA", attempts[0].Name)
+			assert.False(t, attempts[1].DryRun)
+			assert.Equal(t, "status", attempts[1].Subresource)
+		}
+	}
+}
+
+func TestAttemptedChangesAreCapped(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	config := gitops.DefaultConfig()
+	config.Ingestion.RecordAttempts = true
+	config.Ingestion.MaxAttempts = 1
+	cr, err := gitops.SetupRepoWithConfig(k8s, gitops.StorageModeInMemory, dir, config)
+	assert.NoError(t, err, "could not set up repo")
+
+	jsonstring, err := ioutil.ReadFile("./files/attempts-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	err = cr.HandleEventList(jsonstring)
+	assert.NoError(t, err, "could not handle audit event list")
+	attempts, err := cr.AttemptedChanges()
+	assert.NoError(t, err, "unable to read attempted changes")
+	// only the most recent attempted change is kept
+	if assert.Len(t, attempts, 1) {
+		assert.Equal(t, "status", attempts[0].Subresource)
+	}
+}
+
 func TestTagging(t *testing.T) {
 	fakeClient := NewClient()
 	k8s := &gitops.K8sClient{
@@ -228,6 +1004,10 @@ func TestRollback(t *testing.T) {
 	assert.NoError(t, err, "could not read rollback-log file")
 	err = cr.HandleEventList(jsonStr)
 	assert.NoError(t, err, "could not process audit events from file")
+	jsonStr, err = ioutil.ReadFile("./files/label-update-audit-log.txt")
+	assert.NoError(t, err, "could not read label-update-audit-log file")
+	err = cr.HandleEventList(jsonStr)
+	assert.NoError(t, err, "could not process audit events from file")
 
 	// Attempt rollback
 	commit, err := cr.TagToCommit("test-tag")
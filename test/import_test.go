@@ -0,0 +1,117 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"antrea-audit/gitops"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+func TestParseEvents(t *testing.T) {
+	eventList, err := ioutil.ReadFile("./files/rollback-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	events, err := gitops.ParseEvents(eventList)
+	assert.NoError(t, err, "unable to parse EventList")
+	assert.Len(t, events, 3)
+
+	var jsonLines []byte
+	for _, line := range readEventLines(t, "./files/correct-audit-log.txt") {
+		jsonLines = append(jsonLines, line...)
+	}
+	events, err = gitops.ParseEvents(append(jsonLines, eventList...))
+	assert.NoError(t, err, "unable to parse JSON lines audit log")
+	assert.Len(t, events, 6)
+
+	_, err = gitops.ParseEvents([]byte("{\"kind\":"))
+	assert.Error(t, err, "should fail to parse truncated audit log")
+}
+
+func TestImportRepo(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "audit-import")
+	assert.NoError(t, err, "unable to create temp dir")
+	defer os.RemoveAll(tmpDir)
+	fakeClient := NewClient(np1.DeepCopy(), np2.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	var parsed []auditv1.Event
+	for _, file := range []string{"./files/rollback-log.txt", "./files/correct-audit-log.txt"} {
+		data, err := ioutil.ReadFile(file)
+		assert.NoError(t, err, "unable to read mock audit log")
+		events, err := gitops.ParseEvents(data)
+		assert.NoError(t, err, "unable to parse mock audit log")
+		parsed = append(parsed, events...)
+	}
+
+	cr, summary, err := gitops.ImportRepo(k8s, tmpDir, gitops.DefaultConfig(), parsed)
+	assert.NoError(t, err, "could not import audit history")
+	assert.Equal(t, &gitops.ImportSummary{Events: 6, Failed: 0, Reconciled: true}, summary)
+
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	cIter, err := cr.Repo.Log(&git.LogOptions{From: h.Hash()})
+	assert.NoError(t, err, "unable to get repo log")
+	var messages []string
+	var createdAt time.Time
+	cIter.ForEach(func(c *object.Commit) error {
+		subject := strings.SplitN(c.Message, "\n", 2)[0]
+		if subject == "Created K8s network policy default/allow-client1" {
+			createdAt = c.Author.When
+		}
+		messages = append(messages, subject)
+		return nil
+	})
+	// events are committed in timestamp order, regardless of the order of the input
+	assert.Equal(t, []string{
+		"Reconcile imported history with cluster state",
+		"Created K8s network policy nsA/npB",
+		"Updated K8s network policy nsA/npA",
+		"Updated K8s network policy default/allow-client1",
+		"Deleted K8s network policy default/allow-client1",
+		"Created K8s network policy default/allow-client1",
+		"Start of imported audit history",
+	}, messages)
+	assert.True(t, createdAt.Equal(time.Date(2021, 6, 10, 20, 48, 2, 0, time.UTC)), "author date should be the event time")
+
+	// the reconciled worktree matches the cluster
+	_, err = cr.Fs.Stat("k8s-policies/default/allow-client1.yaml")
+	assert.True(t, os.IsNotExist(err), "resource missing from the cluster should be removed")
+	_, err = cr.Fs.Stat("k8s-policies/nsA/npB.yaml")
+	assert.NoError(t, err, "resource in the cluster should be kept")
+
+	_, _, err = gitops.ImportRepo(k8s, tmpDir, gitops.DefaultConfig(), parsed)
+	assert.Error(t, err, "import should not overwrite an existing repository")
+}
+
+func TestImportRepoSkipsIncompleteAndReadRequests(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "audit-import")
+	assert.NoError(t, err, "unable to create temp dir")
+	defer os.RemoveAll(tmpDir)
+	fakeClient := NewClient(np1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	// a get request and a RequestReceived stage are not counted, the patch of npA whose
+	// response object cannot be read is a failure
+	var parsed []auditv1.Event
+	for _, file := range []string{"./files/read-audit-log.txt", "./files/stages-audit-log.txt", "./files/partial-failure-audit-log.txt"} {
+		data, err := ioutil.ReadFile(file)
+		assert.NoError(t, err, "unable to read mock audit log")
+		events, err := gitops.ParseEvents(data)
+		assert.NoError(t, err, "unable to parse mock audit log")
+		parsed = append(parsed, events...)
+	}
+
+	_, summary, err := gitops.ImportRepo(k8s, tmpDir, gitops.DefaultConfig(), parsed)
+	assert.NoError(t, err, "could not import audit history")
+	assert.Equal(t, 4, summary.Events)
+	assert.Equal(t, 1, summary.Failed)
+}
@@ -0,0 +1,113 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"antrea-audit/gitops"
+	"antrea-audit/webhook"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getChanges(t *testing.T, req *http.Request) []webhook.Change {
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err, "unable to get changes")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var changes []webhook.Change
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err, "unable to read changes")
+	assert.NoError(t, json.Unmarshal(body, &changes), "unable to unmarshal changes")
+	return changes
+}
+
+const clustersConfig = `clusters:
+- name: east
+  kubeconfig: /etc/audit/east.kubeconfig
+  username: audit-webhook
+- name: west
+  kubeconfig: /etc/audit/west.kubeconfig
+  context: west-admin
+  username: audit-webhook
+`
+
+func TestLoadClustersConfig(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "audit-config")
+	assert.NoError(t, err, "unable to create temp dir")
+	defer os.RemoveAll(tmpDir)
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	assert.NoError(t, ioutil.WriteFile(configPath, []byte(clustersConfig), 0600), "unable to write config file")
+	config, err := gitops.LoadConfig(configPath)
+	assert.NoError(t, err, "unable to load config")
+	assert.Equal(t, []gitops.ClusterConfig{
+		{Name: "east", Kubeconfig: "/etc/audit/east.kubeconfig", Username: "audit-webhook"},
+		{Name: "west", Kubeconfig: "/etc/audit/west.kubeconfig", Context: "west-admin", Username: "audit-webhook"},
+	}, config.Clusters)
+	assert.Equal(t, filepath.Join(tmpDir, "clusters", "east"), gitops.ClusterDir(tmpDir, "east"))
+
+	assert.NoError(t, ioutil.WriteFile(configPath, []byte(clustersConfig+"- name: east\n  kubeconfig: east\n  username: audit-webhook\n"), 0600), "unable to write config file")
+	_, err = gitops.LoadConfig(configPath)
+	assert.Error(t, err, "should reject duplicate cluster names")
+}
+
+func TestLoadClustersConfigRequiresUsername(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "audit-config")
+	assert.NoError(t, err, "unable to create temp dir")
+	defer os.RemoveAll(tmpDir)
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	assert.NoError(t, ioutil.WriteFile(configPath, []byte(clustersConfig+"- name: north\n  kubeconfig: north\n"), 0600), "unable to write config file")
+	_, err = gitops.LoadConfig(configPath)
+	assert.Error(t, err, "should reject a kubeconfig without username")
+}
+
+func TestMultiClusterServer(t *testing.T) {
+	east, err := gitops.SetupRepo(&gitops.K8sClient{Client: NewClient(np1.DeepCopy())}, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "unable to set up east repo")
+	west, err := gitops.SetupRepo(&gitops.K8sClient{Client: NewClient(np2.DeepCopy())}, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "unable to set up west repo")
+	server, err := webhook.NewServer(map[string]*gitops.CustomRepo{"east": east, "west": west}, "")
+	assert.NoError(t, err, "unable to create server")
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go server.Run(stopCh)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	jsonstring, err := ioutil.ReadFile("./files/correct-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	resp, err := http.Post(ts.URL+"/clusters/east/events", "application/json", bytes.NewBuffer(jsonstring))
+	assert.NoError(t, err, "unable to post audit events")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Eventually(t, func() bool {
+		east.Mutex.Lock()
+		defer east.Mutex.Unlock()
+		return countCommits(t, east) > 1
+	}, 5*time.Second, 10*time.Millisecond, "audit events should be committed to the east repository")
+
+	req, _ := http.NewRequest("GET", ts.URL+"/clusters/west/changes", nil)
+	changes := getChanges(t, req)
+	assert.Len(t, changes, 1, "west repository should only hold the initial commit")
+	req, _ = http.NewRequest("GET", ts.URL+"/changes", nil)
+	req.Header.Set("X-Audit-Cluster", "east")
+	changes = getChanges(t, req)
+	assert.Greater(t, len(changes), 1)
+	assert.Equal(t, "kubernetes-admin", changes[0].Author)
+
+	resp, err = http.Get(ts.URL + "/clusters/north/changes")
+	assert.NoError(t, err, "unable to get changes")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, err = http.Get(ts.URL + "/changes")
+	assert.NoError(t, err, "unable to get changes")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "requests must select a cluster without a default cluster")
+}
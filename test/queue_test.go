@@ -0,0 +1,184 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"antrea-audit/gitops"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventQueue(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy(), np2.DeepCopy(), anp1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	queue, err := gitops.NewEventQueue(cr)
+	assert.NoError(t, err, "could not create ingestion queue")
+
+	jsonstring, err := ioutil.ReadFile("./files/collection-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	assert.NoError(t, queue.Enqueue(jsonstring), "could not enqueue audit event list")
+	assert.Equal(t, 1, queue.Len())
+	assert.ErrorIs(t, queue.Enqueue([]byte("not an event list")), gitops.ErrInvalidEventList)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go queue.Run(stopCh)
+	assert.Eventually(t, func() bool { return queue.Len() == 0 }, 5*time.Second, 10*time.Millisecond)
+	cr.Mutex.Lock()
+	newH, err := cr.Repo.Head()
+	cr.Mutex.Unlock()
+	assert.NoError(t, err, "unable to get repo head ref")
+	assert.NotEqual(t, h.Hash(), newH.Hash(), "queued audit events should be committed")
+}
+
+func TestEventQueueFull(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "audit-queue")
+	assert.NoError(t, err, "unable to create temp dir")
+	defer os.RemoveAll(tmpDir)
+	fakeClient := NewClient(np1.DeepCopy(), np2.DeepCopy(), anp1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	config := gitops.DefaultConfig()
+	config.Ingestion.QueueSize = 1
+	cr, err := gitops.SetupRepoWithConfig(k8s, gitops.StorageModeDisk, tmpDir, config)
+	assert.NoError(t, err, "could not set up repo")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	queue, err := gitops.NewEventQueue(cr)
+	assert.NoError(t, err, "could not create ingestion queue")
+
+	jsonstring, err := ioutil.ReadFile("./files/collection-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	assert.NoError(t, queue.Enqueue(jsonstring), "could not enqueue audit event list")
+	assert.ErrorIs(t, queue.Enqueue(jsonstring), gitops.ErrQueueFull)
+
+	// Queued event lists survive a restart
+	cr, err = gitops.SetupRepoWithConfig(k8s, gitops.StorageModeDisk, tmpDir, config)
+	assert.NoError(t, err, "could not reopen repo")
+	queue, err = gitops.NewEventQueue(cr)
+	assert.NoError(t, err, "could not recreate ingestion queue")
+	assert.Equal(t, 1, queue.Len())
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go queue.Run(stopCh)
+	assert.Eventually(t, func() bool { return queue.Len() == 0 }, 5*time.Second, 10*time.Millisecond)
+	cr.Mutex.Lock()
+	newH, err := cr.Repo.Head()
+	cr.Mutex.Unlock()
+	assert.NoError(t, err, "unable to get repo head ref")
+	assert.NotEqual(t, h.Hash(), newH.Hash(), "reloaded audit events should be committed")
+	assert.NoError(t, queue.Enqueue(jsonstring), "queue should accept event lists once drained")
+}
+
+func TestEventQueueRetriesFailedLists(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	queue, err := gitops.NewEventQueue(cr)
+	assert.NoError(t, err, "could not create ingestion queue")
+
+	// the resources deleted by the selector cannot be listed
+	k8s.Client = &unservedGroupClient{Client: fakeClient, group: "networking.k8s.io"}
+	jsonstring, err := ioutil.ReadFile("./files/selector-collection-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	assert.NoError(t, queue.Enqueue(jsonstring), "could not enqueue audit event list")
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go queue.Run(stopCh)
+	assert.Eventually(t, func() bool {
+		failures, _ := queue.Failures()
+		return failures > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	// Acknowledged events which cannot be applied are kept in the queue
+	assert.Equal(t, 1, queue.Len())
+	_, lastError := queue.Failures()
+	assert.NotEmpty(t, lastError)
+}
+
+func TestEventQueueSkipsReadRequests(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	queue, err := gitops.NewEventQueue(cr)
+	assert.NoError(t, err, "could not create ingestion queue")
+
+	// a get request followed by a create
+	jsonstring, err := ioutil.ReadFile("./files/read-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	assert.NoError(t, queue.Enqueue(jsonstring), "could not enqueue audit event list")
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go queue.Run(stopCh)
+	assert.Eventually(t, func() bool { return queue.Len() == 0 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, queue.DeadLettered())
+	cr.Mutex.Lock()
+	defer cr.Mutex.Unlock()
+	assert.Equal(t, 2, countCommits(t, cr))
+	_, err = cr.Fs.Stat("k8s-policies/nsA/npC.yaml")
+	assert.NoError(t, err, "created resource should be committed")
+}
+
+func TestEventQueueDeadLettersUnsupportedLists(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "audit-queue")
+	assert.NoError(t, err, "unable to create temp dir")
+	defer os.RemoveAll(tmpDir)
+	fakeClient := NewClient(np1.DeepCopy(), np2.DeepCopy(), anp1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeDisk, tmpDir)
+	assert.NoError(t, err, "could not set up repo")
+	queue, err := gitops.NewEventQueue(cr)
+	assert.NoError(t, err, "could not create ingestion queue")
+
+	// the response object of the patch of npA cannot be read
+	jsonstring, err := ioutil.ReadFile("./files/partial-failure-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	assert.NoError(t, queue.Enqueue(jsonstring), "could not enqueue audit event list")
+	jsonstring, err = ioutil.ReadFile("./files/collection-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	assert.NoError(t, queue.Enqueue(jsonstring), "could not enqueue audit event list")
+
+	stopCh := make(chan struct{})
+	go queue.Run(stopCh)
+	assert.Eventually(t, func() bool { return queue.Len() == 0 }, 5*time.Second, 10*time.Millisecond)
+	close(stopCh)
+	assert.Equal(t, 1, queue.DeadLettered())
+	_, err = os.Stat(filepath.Join(tmpDir, "resource-auditing-repo", ".git", "audit", "queue-dead-letter", "00000000000000000000.json"))
+	assert.NoError(t, err, "event list which cannot be applied should be kept in the dead-letter directory")
+	cr.Mutex.Lock()
+	h, err := cr.Repo.Head()
+	cr.Mutex.Unlock()
+	assert.NoError(t, err, "unable to get repo head ref")
+	headCommit, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get head commit")
+	assert.Contains(t, headCommit.Message, "Audit-ID: 5f0e2a61-2b0c-4a3e-9d43-0c6d1f1b7a02", "following event lists should be applied")
+
+	// Dead-lettered event lists are still reported after a restart
+	cr, err = gitops.SetupRepo(k8s, gitops.StorageModeDisk, tmpDir)
+	assert.NoError(t, err, "could not reopen repo")
+	queue, err = gitops.NewEventQueue(cr)
+	assert.NoError(t, err, "could not recreate ingestion queue")
+	assert.Equal(t, 0, queue.Len())
+	assert.Equal(t, 1, queue.DeadLettered())
+}
@@ -0,0 +1,187 @@
+package test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"antrea-audit/gitops"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestRecordOfflineChanges(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "audit-restart")
+	assert.NoError(t, err, "unable to create temp dir")
+	defer os.RemoveAll(tmpDir)
+	k8s := &gitops.K8sClient{
+		Client: NewClient(np1.DeepCopy(), anp1.DeepCopy()),
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeDisk, tmpDir)
+	assert.NoError(t, err, "unable to set up repo")
+	cr, err = gitops.SetupRepo(k8s, gitops.StorageModeDisk, tmpDir)
+	assert.NoError(t, err, "unable to open existing repo")
+	assert.NoError(t, cr.RecordOfflineChanges(), "unable to record offline changes")
+	assert.Equal(t, 1, countCommits(t, cr), "restarting without offline changes should not commit")
+
+	// Events accepted but not applied before the restart
+	queue, err := gitops.NewEventQueue(cr)
+	assert.NoError(t, err, "could not create ingestion queue")
+	jsonstring, err := ioutil.ReadFile("./files/correct-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	assert.NoError(t, queue.Enqueue(jsonstring), "could not enqueue audit event list")
+
+	// Changes made while the webhook is not running
+	r := unstructured.Unstructured{}
+	r.Object, err = runtime.DefaultUnstructuredConverter.ToUnstructured(np2)
+	assert.NoError(t, err, "unable to convert typed to unstructured object")
+	assert.NoError(t, k8s.CreateOrUpdateResource(&r), "unable to create new resource")
+	r = unstructured.Unstructured{}
+	r.Object, err = runtime.DefaultUnstructuredConverter.ToUnstructured(anp1)
+	assert.NoError(t, err, "unable to convert typed to unstructured object")
+	assert.NoError(t, k8s.DeleteResource(&r), "unable to delete resource")
+
+	cr, err = gitops.SetupRepo(k8s, gitops.StorageModeDisk, tmpDir)
+	assert.NoError(t, err, "unable to open existing repo")
+	assert.NoError(t, cr.RecordOfflineChanges(), "unable to record offline changes")
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	commit, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get head commit")
+	assert.Equal(t, "Offline changes: update repository to match cluster state", commit.Message)
+	parent, err := commit.Parent(0)
+	assert.NoError(t, err, "unable to get parent commit")
+	assert.True(t, strings.HasPrefix(parent.Message, "Updated K8s network policy default/allow-client1"),
+		"queued audit events should be applied before recording offline changes")
+	_, err = cr.Fs.Stat("k8s-policies/nsA/npB.yaml")
+	assert.NoError(t, err, "resource created while offline should be recorded")
+	_, err = cr.Fs.Stat("antrea-policies/nsA/anpA.yaml")
+	assert.Error(t, err, "resource deleted while offline should be removed")
+	_, err = cr.Fs.Stat("k8s-policies/default/allow-client1.yaml")
+	assert.Error(t, err, "resource missing from the cluster should be removed")
+
+	queue, err = gitops.NewEventQueue(cr)
+	assert.NoError(t, err, "could not create ingestion queue")
+	assert.Equal(t, 0, queue.Len(), "queued audit events should have been applied")
+}
+
+func TestRecordOfflineChangesKeepsFailedQueuedEvents(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "audit-restart")
+	assert.NoError(t, err, "unable to create temp dir")
+	defer os.RemoveAll(tmpDir)
+	fakeClient := NewClient(np1.DeepCopy(), anp1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeDisk, tmpDir)
+	assert.NoError(t, err, "unable to set up repo")
+	queue, err := gitops.NewEventQueue(cr)
+	assert.NoError(t, err, "could not create ingestion queue")
+	jsonstring, err := ioutil.ReadFile("./files/selector-collection-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	assert.NoError(t, queue.Enqueue(jsonstring), "could not enqueue audit event list")
+	assert.NoError(t, fakeClient.Delete(context.TODO(), anp1.DeepCopy()), "unable to delete policy")
+
+	// the resources deleted by the selector cannot be listed
+	k8s.Client = &unservedGroupClient{Client: fakeClient, group: "networking.k8s.io"}
+	cr, err = gitops.SetupRepo(k8s, gitops.StorageModeDisk, tmpDir)
+	assert.NoError(t, err, "unable to open existing repo")
+	assert.NoError(t, cr.RecordOfflineChanges(), "unable to record offline changes")
+	assert.Equal(t, 1, countCommits(t, cr))
+	assert.True(t, cr.OfflineChangesPending(), "offline changes should wait for the queued audit events")
+	queue, err = gitops.NewEventQueue(cr)
+	assert.NoError(t, err, "could not create ingestion queue")
+	assert.Equal(t, 1, queue.Len(), "queued audit events which cannot be applied yet should be kept")
+
+	// Offline changes are recorded once the queue has been drained
+	k8s.Client = fakeClient
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go queue.Run(stopCh)
+	assert.Eventually(t, func() bool { return !cr.OfflineChangesPending() }, 5*time.Second, 10*time.Millisecond)
+	cr.Mutex.Lock()
+	defer cr.Mutex.Unlock()
+	assert.Equal(t, 0, queue.Len())
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	commit, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get head commit")
+	assert.Equal(t, "Offline changes: update repository to match cluster state", commit.Message)
+	_, err = cr.Fs.Stat("antrea-policies/nsA/anpA.yaml")
+	assert.Error(t, err, "resource deleted while offline should be removed")
+}
+
+func TestRecordOfflineChangesDeadLettersUnsupportedQueuedEvents(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "audit-restart")
+	assert.NoError(t, err, "unable to create temp dir")
+	defer os.RemoveAll(tmpDir)
+	fakeClient := NewClient(np1.DeepCopy(), anp1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeDisk, tmpDir)
+	assert.NoError(t, err, "unable to set up repo")
+	queue, err := gitops.NewEventQueue(cr)
+	assert.NoError(t, err, "could not create ingestion queue")
+	// the response object of the patch of npA cannot be read
+	jsonstring, err := ioutil.ReadFile("./files/partial-failure-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	assert.NoError(t, queue.Enqueue(jsonstring), "could not enqueue audit event list")
+	assert.NoError(t, fakeClient.Delete(context.TODO(), anp1.DeepCopy()), "unable to delete policy")
+
+	cr, err = gitops.SetupRepo(k8s, gitops.StorageModeDisk, tmpDir)
+	assert.NoError(t, err, "unable to open existing repo")
+	assert.NoError(t, cr.RecordOfflineChanges(), "unable to record offline changes")
+	assert.False(t, cr.OfflineChangesPending())
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	commit, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get head commit")
+	assert.Equal(t, "Offline changes: update repository to match cluster state", commit.Message)
+	queue, err = gitops.NewEventQueue(cr)
+	assert.NoError(t, err, "could not create ingestion queue")
+	assert.Equal(t, 0, queue.Len())
+	assert.Equal(t, 1, queue.DeadLettered(), "queued audit events which can never be applied should be dead-lettered")
+}
+
+// unservedGroupClient behaves as if the resources of an API group were not served, e.g. because
+// their CRDs are missing.
+type unservedGroupClient struct {
+	client.Client
+	group string
+}
+
+func (c *unservedGroupClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	gvk := list.GetObjectKind().GroupVersionKind()
+	if gvk.Group == c.group {
+		return &meta.NoKindMatchError{GroupKind: gvk.GroupKind()}
+	}
+	return c.Client.List(ctx, list, opts...)
+}
+
+func TestRecordOfflineChangesKeepsUnservedResources(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "audit-restart")
+	assert.NoError(t, err, "unable to create temp dir")
+	defer os.RemoveAll(tmpDir)
+	fakeClient := NewClient(np1.DeepCopy(), anp1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	_, err = gitops.SetupRepo(k8s, gitops.StorageModeDisk, tmpDir)
+	assert.NoError(t, err, "unable to set up repo")
+
+	k8s.Client = &unservedGroupClient{Client: fakeClient, group: "crd.antrea.io"}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeDisk, tmpDir)
+	assert.NoError(t, err, "unable to open existing repo")
+	assert.NoError(t, cr.RecordOfflineChanges(), "unable to record offline changes")
+	assert.Equal(t, 1, countCommits(t, cr), "resources of unserved types should not be removed")
+	_, err = cr.Fs.Stat("antrea-policies/nsA/anpA.yaml")
+	assert.NoError(t, err, "resource of unserved type should be kept")
+}
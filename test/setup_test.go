@@ -2,12 +2,15 @@ package test
 
 import (
 	"antrea-audit/gitops"
+	"io/ioutil"
 	"testing"
 
 	crdv1alpha1 "antrea.io/antrea/pkg/apis/crd/v1alpha1"
 	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -207,9 +210,6 @@ spec:
         foo1: bar1
   egress:
   - action: Allow
-    enableLogging: false
-    from: null
-    name: ""
     ports:
     - port: 81
     to:
@@ -221,7 +221,6 @@ spec:
           foo2: bar2
   ingress:
   - action: Allow
-    enableLogging: false
     from:
     - namespaceSelector:
         matchLabels:
@@ -229,10 +228,8 @@ spec:
       podSelector:
         matchLabels:
           foo2: bar2
-    name: ""
     ports:
     - port: 80
-    to: null
   priority: 10
 `,
 	}
@@ -292,9 +289,6 @@ spec:
         foo1: bar1
   egress:
   - action: Allow
-    enableLogging: false
-    from: null
-    name: ""
     ports:
     - port: 81
     to:
@@ -306,7 +300,6 @@ spec:
           foo2: bar2
   ingress:
   - action: Allow
-    enableLogging: false
     from:
     - namespaceSelector:
         matchLabels:
@@ -314,10 +307,8 @@ spec:
       podSelector:
         matchLabels:
           foo2: bar2
-    name: ""
     ports:
     - port: 80
-    to: null
   priority: 10
 `,
 	}
@@ -401,6 +392,52 @@ func runSetupTest(t *testing.T, k8s *gitops.K8sClient, expPaths []string, expYam
 	}
 }
 
+func TestSetupRepoGroups(t *testing.T) {
+	cg := &unstructured.Unstructured{}
+	cg.SetAPIVersion("crd.antrea.io/v1alpha3")
+	cg.SetKind("ClusterGroup")
+	cg.SetName("cgA")
+	cg.SetUID("uidCg")
+	err := unstructured.SetNestedStringMap(cg.Object, map[string]string{"foo1": "bar1"}, "spec", "podSelector", "matchLabels")
+	assert.NoError(t, err, "unable to set cluster group selector")
+	g := &unstructured.Unstructured{}
+	g.SetAPIVersion("crd.antrea.io/v1alpha3")
+	g.SetKind("Group")
+	g.SetNamespace("nsA")
+	g.SetName("gA")
+	err = unstructured.SetNestedStringMap(g.Object, map[string]string{"foo2": "bar2"}, "spec", "podSelector", "matchLabels")
+	assert.NoError(t, err, "unable to set group selector")
+
+	fakeClient := NewClient(Np1.inputResource, cg, g)
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	runSetupTest(t, k8s, []string{
+		"/antrea-cluster-groups/cgA.yaml",
+		"/antrea-groups/nsA/gA.yaml",
+	}, []string{
+		`apiVersion: crd.antrea.io/v1alpha3
+kind: ClusterGroup
+metadata:
+  name: cgA
+spec:
+  podSelector:
+    matchLabels:
+      foo1: bar1
+`,
+		`apiVersion: crd.antrea.io/v1alpha3
+kind: Group
+metadata:
+  name: gA
+  namespace: nsA
+spec:
+  podSelector:
+    matchLabels:
+      foo2: bar2
+`,
+	})
+}
+
 func TestRepoDuplicate(t *testing.T) {
 	fakeClient := NewClient(Np1.inputResource, Anp1.inputResource)
 	k8s := &gitops.K8sClient{
@@ -421,3 +458,81 @@ func NewClient(objects ...runtime.Object) client.WithWatch {
 	client := clientBuilder.Build()
 	return client
 }
+
+func TestSetupRepoCanonicalYaml(t *testing.T) {
+	tcp := corev1.ProtocolTCP
+	udp := corev1.ProtocolUDP
+	np := &networkingv1.NetworkPolicy{
+		TypeMeta: metav1.TypeMeta{Kind: "NetworkPolicy", APIVersion: "networking.k8s.io/v1"},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "nsA",
+			Name:        "npD",
+			UID:         "uidD",
+			Annotations: map[string]string{"kubectl.kubernetes.io/last-applied-configuration": "{}"},
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{
+				{
+					Ports: []networkingv1.NetworkPolicyPort{
+						{Protocol: &tcp, Port: &int80},
+						{Protocol: &udp, Port: &int81},
+					},
+					From: []networkingv1.NetworkPolicyPeer{},
+				},
+			},
+		},
+	}
+	expYaml := `apiVersion: networking.k8s.io/v1
+kind: NetworkPolicy
+metadata:
+  name: npD
+  namespace: nsA
+spec:
+  ingress:
+  - ports:
+    - port: 80
+    - port: 81
+      protocol: UDP
+  podSelector: {}
+  policyTypes:
+  - Ingress
+`
+	k8s := &gitops.K8sClient{
+		Client: NewClient(np),
+	}
+	runSetupTest(t, k8s, []string{"/k8s-policies/nsA/npD.yaml"}, []string{expYaml})
+}
+
+func TestCanonicalYamlKeepsEmptyLists(t *testing.T) {
+	k8s := &gitops.K8sClient{
+		Client: NewClient(),
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "could not set up repo")
+	jsonstring, err := ioutil.ReadFile("./files/empty-rules-audit-log.txt")
+	assert.NoError(t, err, "unable to read mock audit log")
+	assert.NoError(t, cr.HandleEventList(jsonstring), "could not handle audit event list")
+
+	expYaml := `apiVersion: networking.k8s.io/v1
+kind: NetworkPolicy
+metadata:
+  name: npE
+  namespace: nsA
+spec:
+  egress:
+  - to: []
+  ingress: []
+  podSelector: {}
+  policyTypes:
+  - Ingress
+  - Egress
+`
+	f, err := cr.Fs.Open("k8s-policies/nsA/npE.yaml")
+	assert.NoError(t, err, "unable to open resource file")
+	defer f.Close()
+	y, err := ioutil.ReadAll(f)
+	assert.NoError(t, err, "unable to read resource file")
+	assert.Equal(t, expYaml, string(y))
+}
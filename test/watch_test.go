@@ -0,0 +1,141 @@
+package test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"antrea-audit/gitops"
+
+	"github.com/stretchr/testify/assert"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// headCommit returns the author and message of the last commit, taking the repository lock
+// as the watch source commits concurrently.
+func headCommit(t *testing.T, cr *gitops.CustomRepo) (string, string) {
+	cr.Mutex.Lock()
+	defer cr.Mutex.Unlock()
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	commit, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get head commit")
+	return commit.Author.Name, commit.Message
+}
+
+func waitForCommit(t *testing.T, cr *gitops.CustomRepo, author string, message string) {
+	var a, m string
+	found := assert.Eventually(t, func() bool {
+		a, m = headCommit(t, cr)
+		return a == author && strings.HasPrefix(m, message)
+	}, 5*time.Second, 20*time.Millisecond)
+	if !found {
+		t.Logf("expected commit %q by %s, last commit is %q by %s", message, author, m, a)
+	}
+}
+
+func TestWatchSource(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "unable to set up repo")
+	source, err := gitops.NewWatchSource(cr)
+	assert.NoError(t, err, "unable to create watch source")
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	numCommits := countCommits(t, cr)
+	go func() {
+		source.Run(stopCh)
+		close(done)
+	}()
+
+	ctx := context.TODO()
+	npB := np2.DeepCopy()
+	npB.ManagedFields = []metav1.ManagedFieldsEntry{
+		{Manager: "kubectl-create", Operation: metav1.ManagedFieldsOperationUpdate, Time: &metav1.Time{Time: time.Now()}},
+	}
+	assert.NoError(t, fakeClient.Create(ctx, npB), "unable to create policy")
+	waitForCommit(t, cr, "kubectl-create", "Created K8s network policy nsA/npB")
+	assert.Equal(t, numCommits+1, countCommits(t, cr), "starting to watch an up-to-date repository should not commit")
+
+	npA := &networkingv1.NetworkPolicy{}
+	assert.NoError(t, fakeClient.Get(ctx, client.ObjectKey{Namespace: "nsA", Name: "npA"}, npA), "unable to get policy")
+	npA.Labels = map[string]string{"app": "watched"}
+	npA.ManagedFields = []metav1.ManagedFieldsEntry{
+		{Manager: "kubectl-create", Operation: metav1.ManagedFieldsOperationUpdate, Time: &metav1.Time{Time: time.Now().Add(-time.Hour)}},
+		{Manager: "kubectl-label", Operation: metav1.ManagedFieldsOperationUpdate, Time: &metav1.Time{Time: time.Now()}},
+	}
+	assert.NoError(t, fakeClient.Update(ctx, npA), "unable to update policy")
+	waitForCommit(t, cr, "kubectl-label", "Updated K8s network policy nsA/npA")
+
+	assert.NoError(t, fakeClient.Delete(ctx, npB), "unable to delete policy")
+	waitForCommit(t, cr, "unknown", "Deleted K8s network policy nsA/npB")
+	close(stopCh)
+	<-done
+	assert.Equal(t, numCommits+3, countCommits(t, cr))
+	_, message := headCommit(t, cr)
+	assert.True(t, strings.HasPrefix(gitops.ParseProvenance(message).AuditID, "watch:"))
+
+	// Changes made while not watching are recorded when the watch restarts
+	assert.NoError(t, fakeClient.Delete(ctx, npA), "unable to delete policy")
+	stopCh = make(chan struct{})
+	done = make(chan struct{})
+	go func() {
+		source.Run(stopCh)
+		close(done)
+	}()
+	waitForCommit(t, cr, "unknown", "Deleted K8s network policy nsA/npA")
+	close(stopCh)
+	<-done
+	_, err = cr.Fs.Stat("k8s-policies/nsA/npA.yaml")
+	assert.Error(t, err, "deleted resource should no longer be in the repository")
+	assert.Equal(t, numCommits+4, countCommits(t, cr))
+}
+
+func TestWatchSourceEventTime(t *testing.T) {
+	fakeClient := NewClient(np1.DeepCopy())
+	k8s := &gitops.K8sClient{
+		Client: fakeClient,
+	}
+	cr, err := gitops.SetupRepo(k8s, gitops.StorageModeInMemory, dir)
+	assert.NoError(t, err, "unable to set up repo")
+	source, err := gitops.NewWatchSource(cr)
+	assert.NoError(t, err, "unable to create watch source")
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		source.Run(stopCh)
+		close(done)
+	}()
+
+	// the creation is recorded once the watch is running
+	ctx := context.TODO()
+	npB := np2.DeepCopy()
+	npB.ManagedFields = []metav1.ManagedFieldsEntry{
+		{Manager: "kubectl-create", Operation: metav1.ManagedFieldsOperationUpdate, Time: &metav1.Time{Time: time.Now()}},
+	}
+	assert.NoError(t, fakeClient.Create(ctx, npB), "unable to create policy")
+	waitForCommit(t, cr, "kubectl-create", "Created K8s network policy nsA/npB")
+
+	writeTime := time.Date(2021, 7, 14, 21, 47, 10, 0, time.UTC)
+	npA := &networkingv1.NetworkPolicy{}
+	assert.NoError(t, fakeClient.Get(ctx, client.ObjectKey{Namespace: "nsA", Name: "npA"}, npA), "unable to get policy")
+	npA.Labels = map[string]string{"app": "watched"}
+	npA.ManagedFields = []metav1.ManagedFieldsEntry{
+		{Manager: "kubectl-label", Operation: metav1.ManagedFieldsOperationUpdate, Time: &metav1.Time{Time: writeTime}},
+	}
+	assert.NoError(t, fakeClient.Update(ctx, npA), "unable to update policy")
+	waitForCommit(t, cr, "kubectl-label", "Updated K8s network policy nsA/npA")
+	close(stopCh)
+	<-done
+	h, err := cr.Repo.Head()
+	assert.NoError(t, err, "unable to get repo head ref")
+	commit, err := cr.Repo.CommitObject(h.Hash())
+	assert.NoError(t, err, "unable to get head commit")
+	assert.True(t, commit.Author.When.Equal(writeTime), "author date should be the time of the last write")
+}
@@ -16,6 +16,7 @@ type TagRequest struct {
 }
 
 type RollbackRequest struct {
-	Tag string `json:"tag,omitempty"`
-	Sha string `json:"sha,omitempty"`
+	Tag    string `json:"tag,omitempty"`
+	Sha    string `json:"sha,omitempty"`
+	DryRun bool   `json:"dryRun,omitempty"`
 }
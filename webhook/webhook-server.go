@@ -2,8 +2,11 @@ package webhook
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 
 	"antrea-audit/gitops"
@@ -13,9 +16,25 @@ import (
 )
 
 type Change struct {
-	Sha     string `json:"sha"`
-	Author  string `json:"author"`
-	Message string `json:"Message"`
+	Sha        string            `json:"sha"`
+	Author     string            `json:"author"`
+	Message    string            `json:"Message"`
+	Provenance gitops.Provenance `json:"provenance"`
+}
+
+type QueueStatus struct {
+	Depth    int `json:"depth"`
+	Capacity int `json:"capacity"`
+	// Failures is the number of consecutive failed attempts to apply the event list at the
+	// head of the queue.
+	Failures  int    `json:"failures,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+	// DeadLettered is the number of event lists moved out of the queue because they contain
+	// events which can never be applied.
+	DeadLettered int `json:"deadLettered,omitempty"`
+	// OfflineChangesPending is set while the changes made when the webhook was not running
+	// wait for the queue to be drained before being recorded.
+	OfflineChangesPending bool `json:"offlineChangesPending,omitempty"`
 }
 
 type Filters struct {
@@ -30,6 +49,8 @@ type Filters struct {
 type rollbackRequest struct {
 	Tag string `json:"tag,omitempty"`
 	Sha string `json:"sha,omitempty"`
+	// DryRun returns the rollback plan instead of rolling back.
+	DryRun bool `json:"dryRun,omitempty"`
 }
 
 type TagRequestType string
@@ -47,7 +68,7 @@ type tagRequest struct {
 	Email  string         `json:"email,omitempty"`
 }
 
-func events(w http.ResponseWriter, r *http.Request, cr *gitops.CustomRepo) {
+func events(w http.ResponseWriter, r *http.Request, queue *gitops.EventQueue) {
 	defer r.Body.Close()
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -56,18 +77,45 @@ func events(w http.ResponseWriter, r *http.Request, cr *gitops.CustomRepo) {
 		return
 	}
 	klog.V(3).Infof("Audit received: %s", string(body))
-	if err := cr.HandleEventList(body); err != nil {
-		if err.Error() == "rollback in progress" {
-			klog.ErrorS(err, "audit received during rollback")
-			w.WriteHeader(http.StatusServiceUnavailable)
+	if err := queue.Enqueue(body); err != nil {
+		if errors.Is(err, gitops.ErrQueueFull) {
+			klog.ErrorS(err, "audit received while ingestion queue is full", "depth", queue.Len())
+			w.WriteHeader(http.StatusTooManyRequests)
+		} else if errors.Is(err, gitops.ErrInvalidEventList) {
+			klog.ErrorS(err, "unable to parse audit event list")
+			w.WriteHeader(http.StatusBadRequest)
 		} else {
-			klog.ErrorS(err, "unable to process audit event list")
+			klog.ErrorS(err, "unable to queue audit event list")
 			w.WriteHeader(http.StatusInternalServerError)
 		}
 		return
 	}
 }
 
+func queueStatus(w http.ResponseWriter, r *http.Request, queue *gitops.EventQueue) {
+	defer r.Body.Close()
+	if r.Method != "GET" {
+		klog.Errorf("queue does not accept non-GET request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	failures, lastError := queue.Failures()
+	jsonstring, err := json.Marshal(QueueStatus{
+		Depth:                 queue.Len(),
+		Capacity:              queue.Capacity(),
+		Failures:              failures,
+		LastError:             lastError,
+		DeadLettered:          queue.DeadLettered(),
+		OfflineChangesPending: queue.OfflineChangesPending(),
+	})
+	if err != nil {
+		klog.ErrorS(err, "unable to marshal queue status")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(jsonstring)
+}
+
 func changes(w http.ResponseWriter, r *http.Request, cr *gitops.CustomRepo) {
 	defer r.Body.Close()
 	if r.Method != "GET" {
@@ -122,6 +170,7 @@ func changes(w http.ResponseWriter, r *http.Request, cr *gitops.CustomRepo) {
 		chg.Sha = c.Hash.String()
 		chg.Author = c.Author.Name
 		chg.Message = c.Message
+		chg.Provenance = gitops.ParseProvenance(c.Message)
 		changes = append(changes, chg)
 	}
 	jsonstring, err := json.Marshal(changes)
@@ -138,6 +187,56 @@ func changes(w http.ResponseWriter, r *http.Request, cr *gitops.CustomRepo) {
 	}
 }
 
+func attempts(w http.ResponseWriter, r *http.Request, cr *gitops.CustomRepo) {
+	defer r.Body.Close()
+	if r.Method != "GET" {
+		klog.Errorf("attempts does not accept non-GET request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	attempts, err := cr.AttemptedChanges()
+	if err != nil {
+		klog.ErrorS(err, "unable to read attempted changes")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	jsonstring, err := json.Marshal(attempts)
+	if err != nil {
+		klog.ErrorS(err, "unable to marshal list of attempted changes")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(jsonstring)
+}
+
+// drift returns the last drift report on GET, running a first check if none has run yet, and
+// runs a new check on POST.
+func drift(w http.ResponseWriter, r *http.Request, detector *gitops.DriftDetector) {
+	defer r.Body.Close()
+	if r.Method != "GET" && r.Method != "POST" {
+		klog.Errorf("drift does not accept non-GET/POST request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	report := detector.LastReport()
+	if r.Method == "POST" || report == nil {
+		var err error
+		report, err = detector.Check()
+		if err != nil {
+			klog.ErrorS(err, "unable to check for drift")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	jsonstring, err := json.Marshal(report)
+	if err != nil {
+		klog.ErrorS(err, "unable to marshal drift report")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write(jsonstring)
+}
+
 func tag(w http.ResponseWriter, r *http.Request, cr *gitops.CustomRepo) {
 	defer r.Body.Close()
 	if r.Method != "POST" {
@@ -204,10 +303,15 @@ func rollback(w http.ResponseWriter, r *http.Request, cr *gitops.CustomRepo) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if rollbackRequest.Tag == "" && rollbackRequest.Sha == "" {
+		klog.Errorf("rollback request must provide a tag or a sha")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 	var commit *object.Commit
 	if rollbackRequest.Tag != "" {
 		commit, err = cr.TagToCommit(rollbackRequest.Tag)
-	} else if rollbackRequest.Sha != "" {
+	} else {
 		commit, err = cr.HashToCommit(rollbackRequest.Sha)
 	}
 	if err != nil {
@@ -216,6 +320,22 @@ func rollback(w http.ResponseWriter, r *http.Request, cr *gitops.CustomRepo) {
 		return
 	}
 
+	if rollbackRequest.DryRun {
+		plan, err := cr.PlanRollback(commit)
+		if err != nil {
+			klog.ErrorS(err, "failed to compute rollback plan")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		jsonstring, err := json.Marshal(plan)
+		if err != nil {
+			klog.ErrorS(err, "unable to marshal rollback plan")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(jsonstring)
+		return
+	}
 	sha, err := cr.RollbackRepo(commit)
 	if err != nil {
 		klog.ErrorS(err, "failed to rollback repo")
@@ -225,21 +345,101 @@ func rollback(w http.ResponseWriter, r *http.Request, cr *gitops.CustomRepo) {
 	w.Write([]byte("Rollback to commit " + sha + " successful"))
 }
 
+// clusterHeader selects the cluster of a request which is not under /clusters/<name>/.
+const clusterHeader = "X-Audit-Cluster"
+
+// Server serves the audit webhook and the repository API of one or more clusters. Requests
+// for a cluster use paths under /clusters/<name>/, e.g. /clusters/east/changes, or the
+// X-Audit-Cluster header; other requests go to the default cluster.
+type Server struct {
+	clusters       map[string]*clusterServer
+	defaultCluster string
+}
+
+type clusterServer struct {
+	cr       *gitops.CustomRepo
+	queue    *gitops.EventQueue
+	detector *gitops.DriftDetector
+}
+
+func NewServer(clusters map[string]*gitops.CustomRepo, defaultCluster string) (*Server, error) {
+	s := &Server{
+		clusters:       map[string]*clusterServer{},
+		defaultCluster: defaultCluster,
+	}
+	for name, cr := range clusters {
+		queue, err := gitops.NewEventQueue(cr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create ingestion queue for cluster %q: %w", name, err)
+		}
+		detector, err := gitops.NewDriftDetector(cr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create drift detector for cluster %q: %w", name, err)
+		}
+		s.clusters[name] = &clusterServer{cr: cr, queue: queue, detector: detector}
+	}
+	return s, nil
+}
+
+// Run applies queued audit events and checks for drift in all clusters until stopCh is closed.
+func (s *Server) Run(stopCh <-chan struct{}) {
+	for _, c := range s.clusters {
+		go c.queue.Run(stopCh)
+		go c.detector.Run(stopCh)
+	}
+	<-stopCh
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, path := s.defaultCluster, r.URL.Path
+	if strings.HasPrefix(path, "/clusters/") {
+		parts := strings.SplitN(strings.TrimPrefix(path, "/clusters/"), "/", 2)
+		name, path = parts[0], "/"
+		if len(parts) == 2 {
+			path += parts[1]
+		}
+	} else if header := r.Header.Get(clusterHeader); header != "" {
+		name = header
+	}
+	c, ok := s.clusters[name]
+	if !ok {
+		klog.Errorf("request for unknown cluster %q", name)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch path {
+	case "/queue":
+		queueStatus(w, r, c.queue)
+	case "/changes":
+		changes(w, r, c.cr)
+	case "/attempts":
+		attempts(w, r, c.cr)
+	case "/drift":
+		drift(w, r, c.detector)
+	case "/rollback":
+		rollback(w, r, c.cr)
+	case "/tag":
+		tag(w, r, c.cr)
+	default:
+		events(w, r, c.queue)
+	}
+}
+
 func ReceiveEvents(port string, cr *gitops.CustomRepo) error {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		events(w, r, cr)
-	})
-	http.HandleFunc("/changes", func(w http.ResponseWriter, r *http.Request) {
-		changes(w, r, cr)
-	})
-	http.HandleFunc("/rollback", func(w http.ResponseWriter, r *http.Request) {
-		rollback(w, r, cr)
-	})
-	http.HandleFunc("/tag", func(w http.ResponseWriter, r *http.Request) {
-		tag(w, r, cr)
-	})
+	return ReceiveClusterEvents(port, map[string]*gitops.CustomRepo{"": cr}, "")
+}
+
+// ReceiveClusterEvents serves the audit webhook for several clusters, each recorded in its own
+// repository.
+func ReceiveClusterEvents(port string, clusters map[string]*gitops.CustomRepo, defaultCluster string) error {
+	server, err := NewServer(clusters, defaultCluster)
+	if err != nil {
+		klog.ErrorS(err, "unable to set up audit webhook server")
+		return err
+	}
+	go server.Run(make(chan struct{}))
 	klog.V(2).Infof("Audit webhook server started, listening on port %s", port)
-	if err := http.ListenAndServe(":"+string(port), nil); err != nil {
+	if err := http.ListenAndServe(":"+string(port), server); err != nil {
 		klog.ErrorS(err, "Audit webhook service died")
 		return err
 	}